@@ -74,3 +74,57 @@ Create the name of the service account to use
 {{- default "default" .Values.serviceAccount.name }}
 {{- end }}
 {{- end }}
+
+{{/*
+Returns "true" if any resource has a policy which needs the PodResources API of the kubelet
+*/}}
+{{- define "k8s-tpm-device-plugin.policyEnabled" -}}
+{{- $enabled := or .Values.pluginSettings.tpmAllowedNamespaces .Values.pluginSettings.tpmAllowedServiceAccounts }}
+{{- range (.Values.config.resources | default list) }}
+{{- if .policy }}{{ $enabled = true }}{{ end }}
+{{- end }}
+{{- if $enabled }}true{{ end }}
+{{- end }}
+
+{{/*
+Returns "true" if any resource has a policy with service accounts which needs to get pods
+*/}}
+{{- define "k8s-tpm-device-plugin.serviceAccountPolicyEnabled" -}}
+{{- $enabled := .Values.pluginSettings.tpmAllowedServiceAccounts }}
+{{- range (.Values.config.resources | default list) }}
+{{- if and .policy .policy.serviceAccounts }}{{ $enabled = true }}{{ end }}
+{{- end }}
+{{- if $enabled }}true{{ end }}
+{{- end }}
+
+{{/*
+The security context of the plugin container with everything that the enabled features need
+*/}}
+{{- define "k8s-tpm-device-plugin.securityContext" -}}
+{{- $sc := deepCopy .Values.securityContext }}
+{{- if .Values.conflictDetection.enabled }}
+{{- $caps := get $sc "capabilities" | default dict }}
+{{- $add := get $caps "add" | default list }}
+{{- $_ := set $caps "add" (concat $add (list "SYS_PTRACE" "DAC_READ_SEARCH") | uniq) }}
+{{- $_ := set $sc "capabilities" $caps }}
+{{- end }}
+{{- if include "k8s-tpm-device-plugin.deviceAccess" . }}
+{{- $_ := set $sc "privileged" true }}
+{{- $_ := set $sc "allowPrivilegeEscalation" true }}
+{{- end }}
+{{- toYaml $sc }}
+{{- end }}
+
+{{/*
+If the plugin opens the TPM itself, which requires access to the devices of the host
+*/}}
+{{- define "k8s-tpm-device-plugin.deviceAccess" -}}
+{{- if or .Values.ek.enabled .Values.pluginSettings.pcrInterval .Values.proxy.enabled }}true{{ end }}
+{{- end }}
+
+{{/*
+The registration mode of the device plugins, defaults to "kubelet"
+*/}}
+{{- define "k8s-tpm-device-plugin.registrationMode" -}}
+{{- .Values.pluginSettings.registrationMode | default "kubelet" }}
+{{- end }}
@@ -0,0 +1,69 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/ek"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/node"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/sysinfo"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+)
+
+// cacheEK reads the endorsement keys once, and caches them in dir. If reading them from the TPM fails,
+// it falls back to the keys which were cached by a previous run. If client is not nil, it annotates
+// the node with the EK hash afterwards. It only fails if there are no cached keys, a failed annotation
+// is only logged as the cached keys can still be mounted into containers.
+func cacheEK(ctx context.Context, l *zap.Logger, info *sysinfo.Info, dir string, client kubernetes.Interface, nodeName string) error {
+	if info.TPMFamily != sysinfo.TPMFamily20 {
+		return fmt.Errorf("endorsement keys are only supported for a TPM 2.0, TPM family is %s", info.TPMFamily)
+	}
+	// prefer the resource manager as it does not interfere with exclusive users of the TPM
+	devicePath := config.TPMDevicePath
+	if info.ResourceManager {
+		devicePath = config.TPMRMDevicePath
+	}
+
+	keys, err := ek.Read(devicePath)
+	if err == nil {
+		if err := keys.Write(dir); err != nil {
+			return fmt.Errorf("caching endorsement keys: %w", err)
+		}
+		l.Info("Cached endorsement keys", zap.String("device", devicePath), zap.String("dir", dir), zap.String("hash", keys.Hash()))
+	} else {
+		l.Warn("Reading endorsement keys failed, falling back to cached keys", zap.String("device", devicePath), zap.Error(err))
+		keys, err = ek.Load(dir)
+		if err != nil {
+			return err
+		}
+		l.Info("Loaded cached endorsement keys", zap.String("dir", dir), zap.String("hash", keys.Hash()))
+	}
+
+	if client != nil {
+		if err := node.Annotate(ctx, client, nodeName, map[string]string{ek.AnnotationHash: keys.Hash()}); err != nil {
+			l.Error("Annotating node with endorsement key hash failed", zap.String("node", nodeName), zap.String("annotation", ek.AnnotationHash), zap.Error(err))
+			return nil
+		}
+		l.Info("Annotated node with endorsement key hash", zap.String("node", nodeName), zap.String("annotation", ek.AnnotationHash))
+	}
+	return nil
+}
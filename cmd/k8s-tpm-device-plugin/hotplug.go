@@ -0,0 +1,66 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+var (
+	// the directories where TPM devices appear and disappear
+	// NOTE: sysfs does not support inotify for all kernels, this is why we watch /dev as well
+	hotplugDirs = []string{"/dev", "/sys/class/tpm", "/sys/class/tpmrm"}
+
+	// a driver reload or rebind creates a burst of events, so we wait until it settled
+	hotplugSettleTime = time.Second
+)
+
+// newHotplugWatcher creates a watcher for all hotplug directories which exist on the node
+func newHotplugWatcher(l *zap.Logger) (*fsnotify.Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("fsnotify: initializing hotplug watcher: %w", err)
+	}
+	for _, dir := range hotplugDirs {
+		if err := fsw.Add(dir); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				l.Debug("Hotplug directory does not exist, not watching it", zap.String("dir", dir))
+				continue
+			}
+			fsw.Close() // nolint: errcheck
+			return nil, fmt.Errorf("fsnotify: failed to add %s to hotplug directories we need to watch: %w", dir, err)
+		}
+		l.Debug("Watching hotplug directory", zap.String("dir", dir))
+	}
+	return fsw, nil
+}
+
+// isTPMHotplugEvent returns true if the event is about a TPM device appearing or disappearing
+func isTPMHotplugEvent(event fsnotify.Event) bool {
+	if !strings.HasPrefix(filepath.Base(event.Name), "tpm") {
+		return false
+	}
+	return event.Has(fsnotify.Create) || event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+
+	"go.uber.org/zap"
+)
+
+var (
+	httpReadHeaderTimeout = time.Second * 10
+	httpShutdownTimeout   = time.Second * 5
+)
+
+// newHTTPServer creates the HTTP server which serves the runtime endpoints of the plugin. These are:
+// - /log/level: GET returns the current log level, PUT changes it if logLevelChange is set (see zap.AtomicLevel.ServeHTTP for details)
+// - /metrics: Prometheus metrics
+// - /pcrs: the latest PCR snapshot as JSON, only if PCR snapshots are enabled (pcrs is not nil)
+func newHTTPServer(addr string, level zap.AtomicLevel, logLevelChange bool, pcrs http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	if logLevelChange {
+		mux.Handle("/log/level", level)
+	} else {
+		mux.Handle("/log/level", readOnly(level))
+	}
+	mux.Handle("/metrics", metrics.Handler())
+	if pcrs != nil {
+		mux.Handle("/pcrs", pcrs)
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+}
+
+// readOnly only passes GET requests to the handler as the HTTP server is not authenticated
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "changing the log level over HTTP is disabled, see --http-log-level-change", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startHTTPServer runs the HTTP server in the background. The returned channel receives an error if
+// the server stops for any other reason than a call to stopHTTPServer.
+func startHTTPServer(l *zap.Logger, srv *http.Server) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		l.Info("Starting HTTP server", zap.String("address", srv.Addr))
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+	return errCh
+}
+
+// stopHTTPServer gracefully shuts down the HTTP server
+func stopHTTPServer(ctx context.Context, l *zap.Logger, srv *http.Server) {
+	ctx, cancel := context.WithTimeout(ctx, httpShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		l.Warn("HTTP server shutdown failed", zap.Error(err))
+		return
+	}
+	l.Info("Stopped HTTP server")
+}
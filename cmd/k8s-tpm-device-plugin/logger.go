@@ -19,11 +19,14 @@ package main
 import (
 	"strings"
 
+	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-func NewLogger(level zapcore.Level, format string, development bool) (*zap.Logger, error) {
+// NewLogger builds the application logger. The log level is passed as an atomic level so that the caller
+// can keep a reference to it and adjust it at runtime.
+func NewLogger(level zap.AtomicLevel, format string, development bool) (*zap.Logger, error) {
 	// we enable callers, stacktraces and functions in development mode only
 	disableCaller := true
 	disableStacktrace := true
@@ -45,7 +48,7 @@ func NewLogger(level zapcore.Level, format string, development bool) (*zap.Logge
 	}
 
 	cfg := zap.Config{
-		Level:             zap.NewAtomicLevelAt(level),
+		Level:             level,
 		Development:       development,
 		DisableCaller:     disableCaller,
 		DisableStacktrace: disableStacktrace,
@@ -69,3 +72,48 @@ func NewLogger(level zapcore.Level, format string, development bool) (*zap.Logge
 	}
 	return cfg.Build()
 }
+
+// stepLogLevel moves the given atomic level by the given number of steps. A negative number of steps makes
+// the logger more verbose, a positive number makes it less verbose. The resulting level is always kept
+// within the range of debug and error level as everything outside of that range makes little sense for us,
+// and so that a message can always be logged at the resulting level (see logAtLevel).
+// It returns the newly set level.
+func stepLogLevel(level zap.AtomicLevel, steps int8) zapcore.Level {
+	newLevel := level.Level() + zapcore.Level(steps)
+	if newLevel < zapcore.DebugLevel {
+		newLevel = zapcore.DebugLevel
+	}
+	if newLevel > zapcore.ErrorLevel {
+		newLevel = zapcore.ErrorLevel
+	}
+	level.SetLevel(newLevel)
+	return newLevel
+}
+
+// logAtLevel logs a message at the given level, which makes sure that a message about a log level change
+// is emitted even if the new level suppresses info messages
+func logAtLevel(l *zap.Logger, level zapcore.Level, msg string, fields ...zap.Field) {
+	if ce := l.Check(level, msg); ce != nil {
+		ce.Write(fields...)
+	}
+}
+
+// initLogger builds the application logger from the log flags, and makes it the global logger.
+// It returns the level as well so that it can be changed at runtime.
+func initLogger(ctx *cli.Context) (*zap.Logger, zap.AtomicLevel) {
+	level := zap.NewAtomicLevelAt(*ctx.Generic("log-level").(*zapcore.Level))
+	l := zap.Must(NewLogger(
+		level,
+		ctx.String("log-format"),
+		ctx.Bool("log-development"),
+	))
+	zap.ReplaceGlobals(l)
+	return l, level
+}
+
+// syncLogger flushes the logger
+func syncLogger(l *zap.Logger) {
+	if err := l.Sync(); err != nil {
+		l.Debug("Flushing logger failed", zap.Error(err))
+	}
+}
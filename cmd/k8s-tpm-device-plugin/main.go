@@ -19,27 +19,38 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
+	"strconv"
 	"syscall"
+	"time"
 
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/audit"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/checkpoint"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/events"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/pcr"
 	"go.githedgehog.com/k8s-tpm-device-plugin/internal/plugin"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/plugin/simulator"
 	"go.githedgehog.com/k8s-tpm-device-plugin/internal/plugin/tpm"
 	"go.githedgehog.com/k8s-tpm-device-plugin/internal/plugin/tpmrm"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/podresources"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/proxy"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/sysinfo"
 	"go.githedgehog.com/k8s-tpm-device-plugin/pkg/version"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"k8s.io/client-go/kubernetes"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-var (
-	defaultLogLevel = zapcore.InfoLevel
-)
+var defaultLogLevel = zapcore.InfoLevel
 
 var description = `
 This is a Kubernetes TPM device plugin. Its purpose is to pass through the TPM
@@ -68,6 +79,14 @@ get access to the device - preferrable as just explained the first one, and
 only in extraordinary circumstances the second one:
 - githedgehog.com/tpmrm: 1
 - githedgehog.com/tpm: 1
+
+On nodes with a TPM 1.2, the /dev/tpmrm0 device is not available, and the
+/dev/tpm0 device can be requested as 'githedgehog.com/tpm12: 1' instead once
+this resource has been enabled explicitly.
+
+These are the default resources. A configuration file (see --config) can
+change their names, and it can define additional resources which expose the
+same devices under different names, each with its own socket.
 `
 
 func main() {
@@ -96,6 +115,195 @@ func main() {
 				Value:   false,
 				EnvVars: []string{"LOG_DEVELOPMENT"},
 			},
+			&cli.StringFlag{
+				Name:    "http-address",
+				Usage:   "address to listen on for the HTTP server which serves runtime endpoints like '/log/level' and '/metrics', disabled if empty",
+				Value:   "",
+				EnvVars: []string{"HTTP_ADDRESS"},
+			},
+			&cli.BoolFlag{
+				Name:    "http-log-level-change",
+				Usage:   "allows changing the log level with PUT requests to '/log/level' of the HTTP server. Note that the HTTP server is not authenticated, so anyone who can reach it can change the log level.",
+				EnvVars: []string{"HTTP_LOG_LEVEL_CHANGE"},
+			},
+			&cli.StringFlag{
+				Name:    "node-name",
+				Usage:   "name of the node the plugin is running on, usually passed in through the downward API",
+				Value:   "",
+				EnvVars: []string{"NODE_NAME"},
+			},
+			&cli.StringFlag{
+				Name:    "kubeconfig",
+				Usage:   "path to a kubeconfig file, uses the in-cluster configuration if empty",
+				Value:   "",
+				EnvVars: []string{"KUBECONFIG"},
+			},
+			&cli.BoolFlag{
+				Name:    "events",
+				Usage:   "posts Kubernetes events against the node for TPM health changes, registration failures and device conflicts, requires the node name",
+				Value:   false,
+				EnvVars: []string{"EVENTS"},
+			},
+			&cli.StringFlag{
+				Name:    "pod-resources-socket",
+				Usage:   "path to the kubelet PodResources API socket which is used to resolve the pods that devices were allocated to",
+				Value:   podresources.DefaultSocket,
+				EnvVars: []string{"POD_RESOURCES_SOCKET"},
+			},
+			&cli.StringFlag{
+				Name:    "audit-log",
+				Usage:   "path of the file to write the allocation audit log to as JSON lines, disabled if empty",
+				Value:   "",
+				EnvVars: []string{"AUDIT_LOG"},
+			},
+			&cli.IntFlag{
+				Name:    "audit-log-max-size",
+				Usage:   "maximum size in megabytes of the audit log before it gets rotated",
+				Value:   100,
+				EnvVars: []string{"AUDIT_LOG_MAX_SIZE"},
+			},
+			&cli.IntFlag{
+				Name:    "audit-log-max-backups",
+				Usage:   "maximum number of rotated audit logs to retain, 0 retains all",
+				Value:   10,
+				EnvVars: []string{"AUDIT_LOG_MAX_BACKUPS"},
+			},
+			&cli.IntFlag{
+				Name:    "audit-log-max-age",
+				Usage:   "maximum number of days to retain rotated audit logs, 0 retains them regardless of their age",
+				Value:   0,
+				EnvVars: []string{"AUDIT_LOG_MAX_AGE"},
+			},
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "path to a configuration file which defines the resources to advertise, the plugin mode, num-tpmrm-devices and pass-tpm2tools-tcti-env-var flags are ignored if set",
+				Value:   "",
+				EnvVars: []string{"CONFIG"},
+			},
+			&cli.StringFlag{
+				Name:    "tpmrm-plugin-mode",
+				Usage:   "enables the plugin for the /dev/tpmrm0 device: enabled, disabled, or auto which only enables it if the device exists",
+				Value:   string(config.ModeEnabled),
+				EnvVars: []string{"TPMRM_PLUGIN_MODE"},
+			},
+			&cli.StringFlag{
+				Name:    "tpm-plugin-mode",
+				Usage:   "enables the plugin for the /dev/tpm0 device: enabled, disabled, or auto which only enables it if the device exists",
+				Value:   string(config.ModeEnabled),
+				EnvVars: []string{"TPM_PLUGIN_MODE"},
+			},
+			&cli.StringFlag{
+				Name:    "tpm12-plugin-mode",
+				Usage:   "enables the plugin for the /dev/tpm0 device of a TPM 1.2: enabled, disabled, or auto which only enables it if the device exists",
+				Value:   string(config.ModeDisabled),
+				EnvVars: []string{"TPM12_PLUGIN_MODE"},
+			},
+			&cli.StringFlag{
+				Name:    "tpm12-policy",
+				Usage:   "what to do with the tpmrm plugin on a node with a TPM 1.2 which is not supported by the resource manager: refuse to start it, or advertise its devices as unhealthy",
+				Value:   string(config.TPM12PolicyRefuse),
+				EnvVars: []string{"TPM12_POLICY"},
+			},
+			&cli.StringFlag{
+				Name:    "registration-mode",
+				Usage:   "how the device plugins register with the kubelet: 'kubelet' calls the registration service of the kubelet and re-registers when the kubelet socket is recreated, 'plugin-watcher' serves the sockets in the kubelet plugins registry directory where the kubelet discovers them on its own",
+				Value:   string(plugin.RegistrationModeKubelet),
+				EnvVars: []string{"REGISTRATION_MODE"},
+			},
+			&cli.StringFlag{
+				Name:    "lock-dir",
+				Usage:   "directory on the host where the instance lock file is kept, usually the state directory. It must not be the socket directory, as the kubelet removes all files in it when it starts.",
+				Value:   plugin.DefaultLockDir,
+				EnvVars: []string{"LOCK_DIR"},
+			},
+			&cli.DurationFlag{
+				Name:    "lock-timeout",
+				Usage:   "how long to wait for another instance of the plugin on the node to release the instance lock before giving up",
+				Value:   time.Minute,
+				EnvVars: []string{"LOCK_TIMEOUT"},
+			},
+			&cli.BoolFlag{
+				Name:    "watch-hotplug",
+				Usage:   "watches /dev and /sys/class/tpm* for TPM devices appearing and disappearing, and sends updated devices to the kubelet",
+				Value:   true,
+				EnvVars: []string{"WATCH_HOTPLUG"},
+			},
+			&cli.StringFlag{
+				Name:    "cdi-spec-dir",
+				Usage:   "directory where the CDI specs for resources which pass their devices as CDI devices are written to",
+				Value:   plugin.DefaultCDISpecDir,
+				EnvVars: []string{"CDI_SPEC_DIR"},
+			},
+			&cli.StringFlag{
+				Name:    "state-dir",
+				Usage:   "directory on the host where the plugin keeps its state, e.g. the checkpoint of all allocations which is reconciled against the kubelet. Disabled if empty.",
+				EnvVars: []string{"STATE_DIR"},
+			},
+			&cli.DurationFlag{
+				Name:    "reconcile-interval",
+				Usage:   "interval at which the checkpoint is reconciled against the device assignments of the kubelet",
+				Value:   time.Minute,
+				EnvVars: []string{"RECONCILE_INTERVAL"},
+			},
+			&cli.StringFlag{
+				Name:    "proxy-dir",
+				Usage:   "directory on the host where the proxy sockets of the allocations of resources in the proxy mode are created",
+				Value:   proxy.DefaultDir,
+				EnvVars: []string{"PROXY_DIR"},
+			},
+			&cli.IntFlag{
+				Name:    "proxy-socket-gid",
+				Usage:   "group ID which owns the proxy sockets, containers which do not run as root need it as a supplemental group to connect",
+				EnvVars: []string{"PROXY_SOCKET_GID"},
+			},
+			&cli.StringFlag{
+				Name:    "ek-dir",
+				Usage:   "reads the endorsement key certificates and public keys of a TPM 2.0 at startup, caches them in this directory on the host, and mounts it read-only into all containers which were allocated a TPM device of the host (not a simulator). Disabled if empty.",
+				EnvVars: []string{"EK_DIR"},
+			},
+			&cli.StringFlag{
+				Name:    "ek-container-path",
+				Usage:   "path in containers where the endorsement key directory is mounted",
+				Value:   "/etc/tpm/ek",
+				EnvVars: []string{"EK_CONTAINER_PATH"},
+			},
+			&cli.BoolFlag{
+				Name:    "ek-node-annotation",
+				Usage:   "annotates the node with the SHA-256 hash of the endorsement key so that registrars can pre-enroll nodes, requires --ek-dir and --node-name",
+				EnvVars: []string{"EK_NODE_ANNOTATION"},
+			},
+			&cli.DurationFlag{
+				Name:    "pcr-interval",
+				Usage:   "takes a snapshot of the PCRs of a TPM 2.0 at this interval, and serves it at /pcrs of the HTTP server and as metrics. Disabled if 0.",
+				EnvVars: []string{"PCR_INTERVAL"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "pcr-banks",
+				Usage:   "the PCR banks of the PCR snapshots",
+				Value:   cli.NewStringSlice("sha256"),
+				EnvVars: []string{"PCR_BANKS"},
+			},
+			&cli.UintSliceFlag{
+				Name:    "pcr-indices",
+				Usage:   "the PCR indices of the PCR snapshots",
+				Value:   cli.NewUintSlice(0, 1, 2, 3, 4, 5, 6, 7),
+				EnvVars: []string{"PCR_INDICES"},
+			},
+			&cli.BoolFlag{
+				Name:    "pcr-node-annotation",
+				Usage:   "annotates the node with the PCR values whenever they change, requires --pcr-interval and --node-name",
+				EnvVars: []string{"PCR_NODE_ANNOTATION"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "tpm-allowed-namespaces",
+				Usage:   "namespaces whose pods are allowed to use the exclusive /dev/tpm0 device of the tpm plugin, all pods are allowed if neither namespaces nor service accounts are set",
+				EnvVars: []string{"TPM_ALLOWED_NAMESPACES"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "tpm-allowed-service-accounts",
+				Usage:   "service accounts ('namespace/name') whose pods are allowed to use the exclusive /dev/tpm0 device of the tpm plugin",
+				EnvVars: []string{"TPM_ALLOWED_SERVICE_ACCOUNTS"},
+			},
 			&cli.UintFlag{
 				Name:    "num-tpmrm-devices",
 				Usage:   "number of artificial /dev/tpmrm0 devices to communicate to the kubelet",
@@ -109,22 +317,16 @@ func main() {
 				EnvVars: []string{"PASS_TPM2TOOLS_TCTI_ENV_VAR"},
 			},
 		},
+		Commands: []*cli.Command{
+			webhookCommand(),
+			versionCommand(),
+		},
 		Action: func(ctx *cli.Context) error {
-			// initialize logger
-			l := zap.Must(NewLogger(
-				*ctx.Generic("log-level").(*zapcore.Level),
-				ctx.String("log-format"),
-				ctx.Bool("log-development"),
-			))
-			defer func() {
-				if err := l.Sync(); err != nil {
-					l.Debug("Flushing logger failed", zap.Error(err))
-				}
-			}()
-			zap.ReplaceGlobals(l)
+			l, level := initLogger(ctx)
+			defer syncLogger(l)
 
 			// run the application
-			if err := run(ctx, l); err != nil {
+			if err := run(ctx, l, level); err != nil {
 				l.Panic("k8s-tpm-device-plugin failed", zap.Error(err))
 			}
 			return nil
@@ -139,70 +341,303 @@ func main() {
 	}
 }
 
-func run(cliCtx *cli.Context, l *zap.Logger) error {
+func run(cliCtx *cli.Context, l *zap.Logger, level zap.AtomicLevel) error {
 	ctx := cliCtx.Context
 
 	// print the version information
-	l.Info("Starting k8s-tpm-device-plugin", zap.String("version", version.Version), zap.String("go", runtime.Version()))
+	buildInfo := version.Get()
+	l.Info("Starting k8s-tpm-device-plugin", versionFields(buildInfo)...)
+	metrics.BuildInfo.WithLabelValues(buildInfo.Version, buildInfo.GitCommit, buildInfo.GitTreeState, buildInfo.BuildDate, buildInfo.GoVersion, buildInfo.DevicePluginAPIVersion).Set(1)
+
+	registration, err := plugin.ParseRegistrationMode(cliCtx.String("registration-mode"))
+	if err != nil {
+		return fmt.Errorf("registration-mode: %w", err)
+	}
+
+	// only one instance of the plugin must serve the sockets on a node, otherwise they remove each other's sockets
+	lock, err := plugin.AcquireLock(ctx, l, cliCtx.String("lock-dir"), cliCtx.Duration("lock-timeout"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			l.Warn("Releasing instance lock failed", zap.Error(err))
+		}
+	}()
 
 	// some of this code has been borrowed from the NVIDIA plugin: https://github.com/NVIDIA/k8s-device-plugin
 	// watch the kubelet for restarts, we do this like other plugins by looking for the kubelet socket to be recreated
 	// this means that we will have to restart our plugin.
-	// NOTE: the restart is necessary as we need to register with the kubelet every time
-	fsw, err := fsnotify.NewWatcher()
-	if err != nil {
-		return fmt.Errorf("fsnotify: initializing watcher: %w", err)
-	}
-	defer fsw.Close()
-	// unfortunately we need to watch the whole directory where the kubelet socket resides
-	// otherwise we will not be able to capture a "create" event for the kubelet socket with inotify (used in the fsnotify package)
-	if err := fsw.Add(filepath.Dir(pluginapi.KubeletSocket)); err != nil {
-		return fmt.Errorf("fsnotify: failed to add %s to files we need to watch: %w", pluginapi.KubeletSocket, err)
+	// NOTE: the restart is necessary as we need to register with the kubelet every time. The plugin watcher of the
+	// kubelet re-discovers our sockets on its own, so there is nothing to watch in this registration mode.
+	var kubeletEvents <-chan fsnotify.Event
+	var kubeletErrors <-chan error
+	if registration == plugin.RegistrationModeKubelet {
+		fsw, err := fsnotify.NewWatcher()
+		if err != nil {
+			return fmt.Errorf("fsnotify: initializing watcher: %w", err)
+		}
+		defer fsw.Close()
+		// unfortunately we need to watch the whole directory where the kubelet socket resides
+		// otherwise we will not be able to capture a "create" event for the kubelet socket with inotify (used in the fsnotify package)
+		if err := fsw.Add(filepath.Dir(pluginapi.KubeletSocket)); err != nil {
+			return fmt.Errorf("fsnotify: failed to add %s to files we need to watch: %w", pluginapi.KubeletSocket, err)
+		}
+		kubeletEvents = fsw.Events
+		kubeletErrors = fsw.Errors
 	}
 
 	// subscribe to OS signals
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	// the PodResources API resolves the pods that devices were allocated to for the audit log, the policies and the checkpoint
+	podResources := podresources.New(cliCtx.String("pod-resources-socket"))
 
-	p1, err := tpmrm.New(l, cliCtx.Uint("num-tpmrm-devices"), cliCtx.Bool("pass-tpm2tools-tcti-env-var"))
+	// the audit log is optional, a nil audit logger discards all records
+	var auditLogger *audit.Logger
+	if path := cliCtx.String("audit-log"); path != "" {
+		auditLogger = audit.New(l, audit.Config{
+			Path:       path,
+			MaxSize:    cliCtx.Int("audit-log-max-size"),
+			MaxBackups: cliCtx.Int("audit-log-max-backups"),
+			MaxAge:     cliCtx.Int("audit-log-max-age"),
+			Node:       cliCtx.String("node-name"),
+		}, podResources)
+		l.Info("Audit log enabled", zap.String("path", path))
+		defer func() {
+			if err := auditLogger.Close(); err != nil {
+				l.Warn("Closing audit log failed", zap.Error(err))
+			}
+		}()
+	}
+
+	// the configuration file defines which resources we advertise, without one we use the classic defaults
+	tpmrmMode, err := config.ParseMode(cliCtx.String("tpmrm-plugin-mode"))
+	if err != nil {
+		return fmt.Errorf("tpmrm-plugin-mode: %w", err)
+	}
+	tpmMode, err := config.ParseMode(cliCtx.String("tpm-plugin-mode"))
+	if err != nil {
+		return fmt.Errorf("tpm-plugin-mode: %w", err)
+	}
+	tpm12Mode, err := config.ParseMode(cliCtx.String("tpm12-plugin-mode"))
+	if err != nil {
+		return fmt.Errorf("tpm12-plugin-mode: %w", err)
+	}
+	tpm12Policy, err := config.ParseTPM12Policy(cliCtx.String("tpm12-policy"))
+	if err != nil {
+		return fmt.Errorf("tpm12-policy: %w", err)
+	}
+	tpmPolicy, err := newTPMPolicy(cliCtx.StringSlice("tpm-allowed-namespaces"), cliCtx.StringSlice("tpm-allowed-service-accounts"))
+	if err != nil {
+		return fmt.Errorf("tpm-allowed-namespaces/tpm-allowed-service-accounts: %w", err)
+	}
+	cfg := config.Default(config.Defaults{
+		NumTPMRMDevices:         cliCtx.Uint("num-tpmrm-devices"),
+		PassTPM2ToolsTCTIEnvVar: cliCtx.Bool("pass-tpm2tools-tcti-env-var"),
+		TPMRMMode:               tpmrmMode,
+		TPMMode:                 tpmMode,
+		TPM12Mode:               tpm12Mode,
+		TPM12Policy:             tpm12Policy,
+		TPMPolicy:               tpmPolicy,
+	})
+	if path := cliCtx.String("config"); path != "" {
+		cfg, err = config.Load(path)
+		if err != nil {
+			return err
+		}
+		l.Info("Loaded configuration file", zap.String("path", path))
+	}
+
+	// the checkpoint is optional, a nil checkpoint records nothing
+	var cp *checkpoint.Checkpoint
+	if dir := cliCtx.String("state-dir"); dir != "" {
+		resourceNames := make([]string, 0, len(cfg.Resources))
+		for _, r := range cfg.Resources {
+			resourceNames = append(resourceNames, r.ResourceName)
+		}
+		cp, err = checkpoint.New(l, dir, resourceNames, podResources)
+		if err != nil {
+			return err
+		}
+		cpCtx, cpCancel := context.WithCancel(ctx)
+		defer cpCancel()
+		go cp.Run(cpCtx, cliCtx.Duration("reconcile-interval"))
+	}
+
+	// a Kubernetes client is only needed by the features which talk to the API server
+	nodeName := cliCtx.String("node-name")
+	nodeFeatures := cliCtx.Bool("events") || cliCtx.Bool("ek-node-annotation") || cliCtx.Bool("pcr-node-annotation")
+	if nodeFeatures && nodeName == "" {
+		return fmt.Errorf("the node name is required to post events or to annotate the node")
+	}
+	var client kubernetes.Interface
+	if nodeFeatures || cfg.HasServiceAccountPolicy() {
+		client, err = newKubernetesClient(cliCtx.String("kubeconfig"))
+		if err != nil {
+			return err
+		}
+	}
+
+	// events are optional as well, a nil event recorder discards all events
+	var eventRecorder *events.Recorder
+	if cliCtx.Bool("events") {
+		eventRecorder = events.New(client, nodeName)
+		l.Info("Posting Kubernetes events enabled", zap.String("node", nodeName))
+		defer eventRecorder.Shutdown()
+	}
+
+	// detect the kernel version, TPM family and resource manager availability
+	// as they decide which plugins can be enabled
+	info, err := sysinfo.Detect()
 	if err != nil {
-		return fmt.Errorf("tpmrm: device plugin create: %w", err)
+		return fmt.Errorf("sysinfo: %w", err)
+	}
+	l.Info("Detected node properties", zap.String("kernelRelease", info.KernelRelease), zap.String("tpmFamily", string(info.TPMFamily)), zap.Bool("resourceManager", info.ResourceManager))
+	metrics.NodeInfo.WithLabelValues(info.KernelRelease, string(info.TPMFamily), strconv.FormatBool(info.ResourceManager)).Set(1)
+	if !info.KernelSupportsResourceManager() {
+		l.Warn("Kernel is too old for the in-kernel resource manager, the /dev/tpmrm0 device is not available", zap.String("kernelRelease", info.KernelRelease))
+	}
+
+	// the endorsement keys are optional, they are only mounted into containers if they could be cached
+	var ekDir string
+	if dir := cliCtx.String("ek-dir"); dir != "" {
+		var annotateClient kubernetes.Interface
+		if cliCtx.Bool("ek-node-annotation") {
+			annotateClient = client
+		}
+		if err := cacheEK(ctx, l, info, dir, annotateClient, nodeName); err != nil {
+			l.Warn("Endorsement keys are not available, they will not be mounted into containers", zap.Error(err))
+		} else {
+			ekDir = dir
+		}
+	}
+
+	// PCR snapshots are optional, they are taken in the background and served by the HTTP server
+	var pcrs http.Handler
+	if interval := cliCtx.Duration("pcr-interval"); interval > 0 {
+		var annotateClient kubernetes.Interface
+		if cliCtx.Bool("pcr-node-annotation") {
+			annotateClient = client
+		}
+		publisher, err := newPCRPublisher(l, info, &pcr.Selection{
+			Banks:   cliCtx.StringSlice("pcr-banks"),
+			Indices: cliCtx.UintSlice("pcr-indices"),
+		}, interval, annotateClient, nodeName)
+		if err != nil {
+			return fmt.Errorf("pcr: %w", err)
+		}
+		if publisher != nil {
+			pcrCtx, pcrCancel := context.WithCancel(ctx)
+			defer pcrCancel()
+			go publisher.Run(pcrCtx)
+			pcrs = publisher
+		}
 	}
-	p2, err := tpm.New(l, cliCtx.Bool("pass-tpm2tools-tcti-env-var"))
+
+	// start the HTTP server if it is enabled
+	var httpErrCh <-chan error
+	if addr := cliCtx.String("http-address"); addr != "" {
+		srv := newHTTPServer(addr, level, cliCtx.Bool("http-log-level-change"), pcrs)
+		httpErrCh = startHTTPServer(l, srv)
+		defer stopHTTPServer(ctx, l, srv)
+	}
+
+	// stops the background work of the plugins, e.g. the garbage collection of released proxies
+	pluginsCtx, pluginsCancel := context.WithCancel(ctx)
+	defer pluginsCancel()
+	plugins, err := newPlugins(pluginsCtx, l, cfg, plugin.Services{
+		Audit:           auditLogger,
+		Checkpoint:      cp,
+		Events:          eventRecorder,
+		CDISpecDir:      cliCtx.String("cdi-spec-dir"),
+		EKDir:           ekDir,
+		EKContainerPath: cliCtx.String("ek-container-path"),
+		ProxyDir:        cliCtx.String("proxy-dir"),
+		ProxySocketGID:  cliCtx.Int("proxy-socket-gid"),
+		Registration:    registration,
+		PodResources:    podResources,
+		Client:          client,
+	})
 	if err != nil {
-		return fmt.Errorf("tpm: device plugin create: %w", err)
+		return err
 	}
-	// start plugin
-	if err := p1.Start(ctx); err != nil {
-		return fmt.Errorf("%s: device plugin failed to start on startup: %w", p1.Name(), err)
+	if len(plugins) == 0 {
+		l.Warn("No device plugins are enabled, nothing will be advertised to the kubelet")
 	}
-	if err := p2.Start(ctx); err != nil {
-		return fmt.Errorf("%s: device plugin failed to start on startup: %w", p2.Name(), err)
+	// start plugins
+	for _, p := range plugins {
+		if err := p.Start(ctx); err != nil {
+			return fmt.Errorf("%s: device plugin failed to start on startup: %w", p.Name(), err)
+		}
 	}
 
+	// watch for TPM devices appearing and disappearing, e.g. vTPMs or driver reloads
+	// NOTE: a nil channel blocks forever, so the run loop works without the hotplug watcher as well
+	var hotplugEvents <-chan fsnotify.Event
+	var hotplugErrors <-chan error
+	if cliCtx.Bool("watch-hotplug") {
+		hotplugWatcher, err := newHotplugWatcher(l)
+		if err != nil {
+			return err
+		}
+		defer hotplugWatcher.Close()
+		hotplugEvents = hotplugWatcher.Events
+		hotplugErrors = hotplugWatcher.Errors
+	}
+	hotplugTimer := time.NewTimer(hotplugSettleTime)
+	hotplugTimer.Stop()
+	defer hotplugTimer.Stop()
+
 runLoop:
 	for {
 		// now watch for events and react to them
 		select {
-		case event := <-fsw.Events:
+		case event := <-kubeletEvents:
 			l.Debug("fsnotify event", zap.Reflect("event", event))
 			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
 				l.Info("fsnotifiy: kubelet socket created, restarting...", zap.String("kubeletSocket", pluginapi.KubeletSocket))
-				if err := restart(ctx, p1, p2); err != nil {
+				if err := restart(ctx, plugins); err != nil {
 					return err
 				}
 			}
-		case err := <-fsw.Errors:
+		case err := <-kubeletErrors:
 			l.Warn("fsnotify error", zap.Error(err))
 
-		// watch for OS signals. SIGHUP means a restart. Any other registered signals signal a shutdown
+		// TPM devices appeared or disappeared, wait until things settled before we rediscover devices
+		case event := <-hotplugEvents:
+			if isTPMHotplugEvent(event) {
+				l.Debug("fsnotify: TPM hotplug event", zap.Reflect("event", event))
+				hotplugTimer.Reset(hotplugSettleTime)
+			}
+		case err := <-hotplugErrors:
+			l.Warn("fsnotify hotplug error", zap.Error(err))
+		case <-hotplugTimer.C:
+			l.Info("TPM devices changed, rediscovering devices...")
+			for _, p := range plugins {
+				p.Update()
+			}
+
+		// the HTTP server is not supposed to stop on its own
+		case err := <-httpErrCh:
+			return fmt.Errorf("http server: %w", err)
+
+		// watch for OS signals. SIGHUP means a restart. SIGUSR1 and SIGUSR2 increase or decrease
+		// the log verbosity. Any other registered signals signal a shutdown
 		case s := <-sigCh:
 			switch s {
 			case syscall.SIGHUP:
 				l.Info("SIGHUP signal received, restarting...")
-				if err := restart(ctx, p1, p2); err != nil {
+				if err := restart(ctx, plugins); err != nil {
 					return err
 				}
+			case syscall.SIGUSR1:
+				newLevel := stepLogLevel(level, -1)
+				logAtLevel(l, newLevel, "SIGUSR1 signal received, increased log verbosity", zap.Stringer("level", newLevel))
+			case syscall.SIGUSR2:
+				newLevel := stepLogLevel(level, 1)
+				logAtLevel(l, newLevel, "SIGUSR2 signal received, decreased log verbosity", zap.Stringer("level", newLevel))
 			default:
 				l.Info("Signal received, shutting down...", zap.String("signal", s.String()))
 				break runLoop
@@ -210,29 +645,124 @@ runLoop:
 		}
 	}
 
-	// stop plugin on regular shutdown
-	if err := p1.Stop(ctx); err != nil {
-		return fmt.Errorf("%s: failed to stop device plugin on shutdown: %w", p1.Name(), err)
-	}
-	if err := p2.Stop(ctx); err != nil {
-		return fmt.Errorf("%s: failed to stop device plugin on shutdown: %w", p2.Name(), err)
+	// stop plugins on regular shutdown
+	for _, p := range plugins {
+		if err := p.Stop(ctx); err != nil {
+			return fmt.Errorf("%s: failed to stop device plugin on shutdown: %w", p.Name(), err)
+		}
 	}
 
 	return nil
 }
 
-func restart(ctx context.Context, p1, p2 plugin.Interface) error {
-	if err := p1.Stop(ctx); err != nil {
-		return fmt.Errorf("%s: failed to stop device plugin on restart: %w", p1.Name(), err)
+// newPlugins creates a device plugin for every configured resource which is enabled
+func newPlugins(ctx context.Context, l *zap.Logger, cfg *config.Config, services plugin.Services) ([]plugin.Interface, error) {
+	plugins := make([]plugin.Interface, 0, len(cfg.Resources))
+	for _, r := range cfg.Resources {
+		// the family of the TPM behind the device of the resource, which is not necessarily tpm0
+		family := sysinfo.TPMFamilyUnknown
+		if r.Kind != config.KindSimulator {
+			var err error
+			family, err = sysinfo.DeviceTPMFamily(r.DevicePath)
+			if err != nil {
+				l.Warn("Detecting TPM family failed", zap.String("plugin", r.Name), zap.String("device", r.DevicePath), zap.Error(err))
+			}
+		}
+		enabled, reason := pluginEnabled(r, family)
+		enabledMetric := 0.0
+		if enabled {
+			enabledMetric = 1.0
+		}
+		metrics.ResourceEnabled.WithLabelValues(r.Name, string(r.Kind), r.ResourceName, string(r.Mode)).Set(enabledMetric)
+		if !enabled {
+			l.Info("Device plugin disabled", zap.String("plugin", r.Name), zap.String("mode", string(r.Mode)), zap.String("reason", reason))
+			continue
+		}
+		l.Info("Device plugin enabled", zap.String("plugin", r.Name), zap.String("mode", string(r.Mode)), zap.String("reason", reason))
+
+		var p plugin.Interface
+		var err error
+		switch r.Kind {
+		case config.KindTPMRM:
+			p, err = tpmrm.New(ctx, l, r, family, services)
+		case config.KindTPM, config.KindTPM12:
+			p, err = tpm.New(l, r, services)
+		case config.KindSimulator:
+			p, err = simulator.New(l, r, services)
+		default:
+			err = fmt.Errorf("unsupported kind '%s'", r.Kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: device plugin create: %w", r.Name, err)
+		}
+		l.Info("Created device plugin", zap.String("plugin", r.Name), zap.String("kind", string(r.Kind)), zap.String("resourceName", r.ResourceName), zap.String("socketName", r.SocketName))
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+// newTPMPolicy returns the policy of the default tpm resource, or nil if it is not restricted
+func newTPMPolicy(namespaces, serviceAccounts []string) (*config.Policy, error) {
+	if len(namespaces) == 0 && len(serviceAccounts) == 0 {
+		return nil, nil
+	}
+	p := &config.Policy{
+		Namespaces:      namespaces,
+		ServiceAccounts: serviceAccounts,
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// pluginEnabled decides based on its mode and the TPM family if the device plugin for a resource should be started.
+// It returns the decision and a human readable reason for it.
+func pluginEnabled(r *config.Resource, family sysinfo.TPMFamily) (bool, string) {
+	var reason string
+	switch r.Mode {
+	case config.ModeEnabled:
+		reason = "enabled by configuration"
+	case config.ModeDisabled:
+		return false, "disabled by configuration"
+	case config.ModeAuto:
+		if r.Kind == config.KindSimulator {
+			target := simulator.Target(r.Simulator)
+			if err := simulator.Check(r.Simulator); err != nil {
+				return false, fmt.Sprintf("auto detection: simulator %s not available: %s", target, err)
+			}
+			return true, fmt.Sprintf("auto detection: simulator %s is available", target)
+		}
+		if err := plugin.CheckDevice(r.DevicePath); err != nil {
+			return false, fmt.Sprintf("auto detection: device %s not available: %s", r.DevicePath, err)
+		}
+		reason = fmt.Sprintf("auto detection: device %s exists", r.DevicePath)
+	default:
+		return false, fmt.Sprintf("unsupported mode '%s'", r.Mode)
 	}
-	if err := p2.Stop(ctx); err != nil {
-		return fmt.Errorf("%s: failed to stop device plugin on restart: %w", p2.Name(), err)
+
+	switch {
+	case r.Kind == config.KindTPMRM && family == sysinfo.TPMFamily12 && r.TPM12Policy == config.TPM12PolicyRefuse:
+		return false, "TPM 1.2 is not supported by the in-kernel resource manager, refused by the TPM 1.2 policy"
+	// the tpm12 kind passes through a TPM 1.2, so that the same device is never handed out by both kinds
+	case r.Kind == config.KindTPM && family == sysinfo.TPMFamily12:
+		return false, "TPM family is 1.2, which is only passed through by the tpm12 kind"
+	case r.Kind == config.KindTPM12 && family != sysinfo.TPMFamily12:
+		return false, fmt.Sprintf("TPM family is %s, but only TPM 1.2 is supported", family)
 	}
-	if err := p1.Start(ctx); err != nil {
-		return fmt.Errorf("%s: Device plugin failed to start on restart: %w", p1.Name(), err)
+	return true, reason
+}
+
+func restart(ctx context.Context, plugins []plugin.Interface) error {
+	for _, p := range plugins {
+		if err := p.Stop(ctx); err != nil {
+			return fmt.Errorf("%s: failed to stop device plugin on restart: %w", p.Name(), err)
+		}
 	}
-	if err := p2.Start(ctx); err != nil {
-		return fmt.Errorf("%s: Device plugin failed to start on restart: %w", p2.Name(), err)
+	for _, p := range plugins {
+		if err := p.Start(ctx); err != nil {
+			return fmt.Errorf("%s: Device plugin failed to start on restart: %w", p.Name(), err)
+		}
 	}
 	return nil
 }
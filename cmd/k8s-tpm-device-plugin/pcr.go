@@ -0,0 +1,44 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/pcr"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/sysinfo"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+)
+
+// newPCRPublisher creates the PCR snapshot publisher. It returns nil if the node does not support PCR snapshots.
+// NOTE: snapshots are only taken through the resource manager, as periodically opening /dev/tpm0 would
+// interfere with the pods which have exclusive access to it.
+func newPCRPublisher(l *zap.Logger, info *sysinfo.Info, sel *pcr.Selection, interval time.Duration, client kubernetes.Interface, nodeName string) (*pcr.Publisher, error) {
+	if info.TPMFamily != sysinfo.TPMFamily20 || !info.ResourceManager {
+		l.Warn("PCR snapshots require a TPM 2.0 and the in-kernel resource manager, PCR snapshots are disabled", zap.String("tpmFamily", string(info.TPMFamily)), zap.Bool("resourceManager", info.ResourceManager))
+		return nil, nil
+	}
+	p, err := pcr.NewPublisher(l, config.TPMRMDevicePath, sel, interval, client, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	l.Info("PCR snapshots enabled", zap.Strings("banks", sel.Banks), zap.Uints("indices", sel.Indices), zap.Duration("interval", interval))
+	return p, nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/pkg/version"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// versionCommand prints the version information of the build
+func versionCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "version",
+		Usage: "prints the version information of the build",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "output format, one of: text, json",
+				Value:   "text",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			info := version.Get()
+			switch output := ctx.String("output"); output {
+			case "text":
+				fmt.Fprint(ctx.App.Writer, info.String())
+			case "json":
+				enc := json.NewEncoder(ctx.App.Writer)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(&info); err != nil {
+					return fmt.Errorf("encoding version information: %w", err)
+				}
+			default:
+				return fmt.Errorf("unsupported output format '%s', must be one of: text, json", output)
+			}
+			return nil
+		},
+	}
+}
+
+// versionFields returns the version information as log fields
+func versionFields(info version.Info) []zap.Field {
+	return []zap.Field{
+		zap.String("version", info.Version),
+		zap.String("gitCommit", info.GitCommit),
+		zap.String("gitTreeState", info.GitTreeState),
+		zap.String("buildDate", info.BuildDate),
+		zap.String("commitDate", info.CommitDate),
+		zap.String("go", info.GoVersion),
+		zap.String("platform", info.Platform),
+		zap.String("devicePluginAPIVersion", info.DevicePluginAPIVersion),
+	}
+}
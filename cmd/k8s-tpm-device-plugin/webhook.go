@@ -0,0 +1,125 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/webhook"
+	"go.githedgehog.com/k8s-tpm-device-plugin/pkg/version"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// webhookCommand runs the binary as a mutating admission webhook instead of a device plugin
+func webhookCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "webhook",
+		Usage: "runs a mutating admission webhook which injects TPM resources into pods with the '" + webhook.AnnotationInject + "' annotation",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "webhook-address",
+				Usage:   "address to listen on for admission reviews",
+				Value:   ":8443",
+				EnvVars: []string{"WEBHOOK_ADDRESS"},
+			},
+			&cli.StringFlag{
+				Name:     "tls-cert-file",
+				Usage:    "TLS certificate of the webhook server",
+				Required: true,
+				EnvVars:  []string{"TLS_CERT_FILE"},
+			},
+			&cli.StringFlag{
+				Name:     "tls-key-file",
+				Usage:    "TLS private key of the webhook server",
+				Required: true,
+				EnvVars:  []string{"TLS_KEY_FILE"},
+			},
+			&cli.BoolFlag{
+				Name:    "inject-event-log",
+				Usage:   "mounts the TPM event log of the host (" + webhook.EventLogPath + ") at " + webhook.EventLogContainerPath + " into containers which get a TPM resource injected",
+				EnvVars: []string{"INJECT_EVENT_LOG"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "restricted-resources",
+				Usage:   "resources which can only be requested by pods in the allowed namespaces",
+				Value:   cli.NewStringSlice("githedgehog.com/tpm"),
+				EnvVars: []string{"RESTRICTED_RESOURCES"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "allowed-namespaces",
+				Usage:   "namespaces which are allowed to request the restricted resources, the restriction is disabled if empty",
+				EnvVars: []string{"ALLOWED_NAMESPACES"},
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			l, _ := initLogger(ctx)
+			defer syncLogger(l)
+
+			if err := runWebhook(ctx, l); err != nil {
+				l.Panic("k8s-tpm-device-plugin webhook failed", zap.Error(err))
+			}
+			return nil
+		},
+	}
+}
+
+func runWebhook(cliCtx *cli.Context, l *zap.Logger) error {
+	ctx := cliCtx.Context
+	l.Info("Starting k8s-tpm-device-plugin webhook", versionFields(version.Get())...)
+
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", webhook.New(l, webhook.Config{
+		InjectEventLog:      cliCtx.Bool("inject-event-log"),
+		RestrictedResources: cliCtx.StringSlice("restricted-resources"),
+		AllowedNamespaces:   cliCtx.StringSlice("allowed-namespaces"),
+	}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := &http.Server{
+		Addr:              cliCtx.String("webhook-address"),
+		Handler:           mux,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		l.Info("Starting webhook server", zap.String("address", srv.Addr))
+		if err := srv.ListenAndServeTLS(cliCtx.String("tls-cert-file"), cliCtx.String("tls-key-file")); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("webhook server: %w", err)
+	case sig := <-sigCh:
+		l.Info("Received signal, shutting down", zap.String("signal", sig.String()))
+	case <-ctx.Done():
+	}
+	stopHTTPServer(ctx, l, srv)
+	return nil
+}
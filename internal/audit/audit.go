@@ -0,0 +1,177 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit records which pods and containers were given access to a TPM device. The records are written
+// as JSON lines to a dedicated and rotated file which is separate from the operational log of the plugin.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/podresources"
+
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	EventAllocate          = "Allocate"
+	EventPreStartContainer = "PreStartContainer"
+)
+
+var (
+	// the kubelet only reports device assignments after the Allocate call returned,
+	// so we need to retry resolving the pod for a little while
+	resolveAttempts = 10
+	resolveInterval = time.Second
+)
+
+// Record is a single audit log entry
+type Record struct {
+	Time         time.Time               `json:"time"`
+	Node         string                  `json:"node,omitempty"`
+	Event        string                  `json:"event"`
+	Plugin       string                  `json:"plugin"`
+	ResourceName string                  `json:"resourceName"`
+	DeviceIDs    []string                `json:"deviceIDs"`
+	Namespace    string                  `json:"namespace,omitempty"`
+	Pod          string                  `json:"pod,omitempty"`
+	Container    string                  `json:"container,omitempty"`
+	ResolveError string                  `json:"resolveError,omitempty"`
+	Devices      []*pluginapi.DeviceSpec `json:"devices,omitempty"`
+	CDIDevices   []*pluginapi.CDIDevice  `json:"cdiDevices,omitempty"`
+	Envs         map[string]string       `json:"envs,omitempty"`
+	Mounts       []*pluginapi.Mount      `json:"mounts,omitempty"`
+}
+
+// Config configures the audit log file and its rotation
+type Config struct {
+	// Path is the file the audit log is written to
+	Path string
+	// MaxSize is the maximum size in megabytes of the audit log before it gets rotated
+	MaxSize int
+	// MaxBackups is the maximum number of rotated audit logs to retain, 0 retains all of them
+	MaxBackups int
+	// MaxAge is the maximum number of days to retain rotated audit logs, 0 retains them regardless of their age
+	MaxAge int
+	// Node is the name of the node which is added to every record
+	Node string
+}
+
+// Logger writes audit records. A nil Logger is valid and discards all records.
+type Logger struct {
+	l        *zap.Logger
+	node     string
+	resolver *podresources.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	w        *lumberjack.Logger
+}
+
+// New creates an audit logger. The resolver is used to resolve the pod and container of every record,
+// and can be nil in which case records are written without them.
+func New(l *zap.Logger, cfg Config, resolver *podresources.Client) *Logger {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Logger{
+		l:        l.With(zap.String("audit", cfg.Path)),
+		node:     cfg.Node,
+		resolver: resolver,
+		ctx:      ctx,
+		cancel:   cancel,
+		w: &lumberjack.Logger{
+			Filename:   cfg.Path,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+		},
+	}
+}
+
+// Record completes the record with the current time and the node name, and writes it to the audit log.
+// Resolving the pod and container happens in the background, so this call never blocks.
+func (a *Logger) Record(r *Record) {
+	// caller safeguard
+	if a == nil {
+		return
+	}
+	r.Time = time.Now()
+	r.Node = a.node
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.resolve(r)
+		a.write(r)
+	}()
+}
+
+func (a *Logger) resolve(r *Record) {
+	if a.resolver == nil || len(r.DeviceIDs) == 0 {
+		return
+	}
+	for i := 0; i < resolveAttempts; i++ {
+		assignment, err := a.resolver.Find(a.ctx, r.ResourceName, r.DeviceIDs)
+		if err != nil {
+			r.ResolveError = err.Error()
+		} else if assignment != nil {
+			r.Namespace = assignment.Namespace
+			r.Pod = assignment.Pod
+			r.Container = assignment.Container
+			r.ResolveError = ""
+			return
+		} else {
+			r.ResolveError = "devices are not assigned to any container"
+		}
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(resolveInterval):
+		}
+	}
+}
+
+func (a *Logger) write(r *Record) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		a.l.Error("Marshaling audit record failed", zap.Error(err))
+		return
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(b); err != nil {
+		a.l.Error("Writing audit record failed", zap.Error(err))
+	}
+}
+
+// Close writes all pending records without waiting for their pods to be resolved, and closes the audit log.
+func (a *Logger) Close() error {
+	// caller safeguard
+	if a == nil {
+		return nil
+	}
+	a.cancel()
+	a.wg.Wait()
+	return a.w.Close()
+}
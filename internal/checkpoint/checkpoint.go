@@ -0,0 +1,336 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package checkpoint persists which devices the plugin handed out, similar to the checkpoint of the device
+// manager of the kubelet. The checkpoint survives restarts of the plugin, and it is reconciled against the
+// PodResources API of the kubelet to find allocations which never made it into a running container.
+package checkpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/podresources"
+
+	"go.uber.org/zap"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// FileName is the name of the checkpoint file in the state directory
+	FileName = "checkpoint.json"
+
+	version = 1
+)
+
+// gracePeriod protects new allocations from being reported as orphaned,
+// because the kubelet only reports an assignment after the Allocate call has returned
+var gracePeriod = time.Minute * 5
+
+// Entry is a single allocation of devices to a container
+type Entry struct {
+	Time         time.Time                            `json:"time"`
+	ResourceName string                               `json:"resourceName"`
+	DeviceIDs    []string                             `json:"deviceIDs"`
+	Namespace    string                               `json:"namespace,omitempty"`
+	Pod          string                               `json:"pod,omitempty"`
+	Container    string                               `json:"container,omitempty"`
+	Response     *pluginapi.ContainerAllocateResponse `json:"response,omitempty"`
+}
+
+// assigned returns true if the entry was resolved to a container at some point
+func (e *Entry) assigned() bool {
+	return e.Pod != ""
+}
+
+type file struct {
+	Version int      `json:"version"`
+	Entries []*Entry `json:"entries"`
+}
+
+// Checkpoint holds the allocations of all resources, and writes them to the checkpoint file on every change.
+// A nil Checkpoint is valid and records nothing.
+type Checkpoint struct {
+	l            *zap.Logger
+	path         string
+	podResources *podresources.Client
+	// resourceNames are the resources of the plugin, untracked devices are only reported for them
+	resourceNames map[string]struct{}
+	mu            sync.Mutex
+	// entries are keyed by resource name and device ID, several keys point to the same entry
+	// if the allocation contains several devices
+	entries map[key]*Entry
+}
+
+type key struct {
+	resourceName string
+	deviceID     string
+}
+
+// New loads the checkpoint from the state directory, or starts with an empty one if there is none yet.
+// A corrupt checkpoint is logged and replaced, as it must not prevent the plugin from starting.
+func New(l *zap.Logger, stateDir string, resourceNames []string, podResources *podresources.Client) (*Checkpoint, error) {
+	if err := os.MkdirAll(stateDir, 0o755); err != nil { // nolint: gosec
+		return nil, fmt.Errorf("creating state directory %s: %w", stateDir, err)
+	}
+	c := &Checkpoint{
+		l:             l.With(zap.String("checkpoint", filepath.Join(stateDir, FileName))),
+		path:          filepath.Join(stateDir, FileName),
+		podResources:  podResources,
+		resourceNames: make(map[string]struct{}, len(resourceNames)),
+		entries:       make(map[key]*Entry),
+	}
+	for _, r := range resourceNames {
+		c.resourceNames[r] = struct{}{}
+	}
+	entries, err := load(c.path)
+	if err != nil {
+		c.l.Warn("Loading checkpoint failed, starting with an empty one", zap.Error(err))
+	}
+	for _, e := range entries {
+		c.add(e)
+	}
+	c.l.Info("Loaded checkpoint", zap.Int("allocations", len(entries)))
+	c.updateMetrics()
+	return c, nil
+}
+
+func load(path string) ([]*Entry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint: %w", err)
+	}
+	if f.Version != version {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", f.Version)
+	}
+	return f.Entries, nil
+}
+
+func (c *Checkpoint) add(e *Entry) {
+	for _, id := range e.DeviceIDs {
+		c.entries[key{resourceName: e.ResourceName, deviceID: id}] = e
+	}
+}
+
+func (c *Checkpoint) remove(e *Entry) {
+	for _, id := range e.DeviceIDs {
+		k := key{resourceName: e.ResourceName, deviceID: id}
+		if c.entries[k] == e {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// Record adds the allocation of the given devices to the checkpoint and writes it. It replaces earlier
+// allocations of the same devices, as the kubelet only reallocates devices once they were released.
+func (c *Checkpoint) Record(resourceName string, deviceIDs []string, cresp *pluginapi.ContainerAllocateResponse) {
+	// caller safeguard
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &Entry{
+		Time:         time.Now(),
+		ResourceName: resourceName,
+		DeviceIDs:    deviceIDs,
+		Response:     cresp,
+	}
+	for _, id := range deviceIDs {
+		if old, ok := c.entries[key{resourceName: resourceName, deviceID: id}]; ok {
+			c.remove(old)
+		}
+	}
+	c.add(e)
+	c.save()
+}
+
+// Run reconciles the checkpoint against the PodResources API of the kubelet
+// at the given interval until the context is cancelled
+func (c *Checkpoint) Run(ctx context.Context, interval time.Duration) {
+	// caller safeguard
+	if c == nil || c.podResources == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Reconcile(ctx); err != nil {
+			c.l.Warn("Reconciling checkpoint failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile compares the checkpoint with the assignments that the kubelet reports. It resolves the containers
+// of new allocations, and removes allocations whose containers are gone. Allocations which were never assigned
+// to a container are orphaned: the container failed to be created, or the kubelet lost its own checkpoint.
+// Devices which the kubelet reports, but which are not in the checkpoint, are reported as untracked.
+func (c *Checkpoint) Reconcile(ctx context.Context) error {
+	assignments, err := c.podResources.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assigned := make(map[key]*podresources.Assignment)
+	untracked := make(map[string]int)
+	for _, a := range assignments {
+		for _, id := range a.DeviceIDs {
+			k := key{resourceName: a.ResourceName, deviceID: id}
+			assigned[k] = a
+			if _, ok := c.resourceNames[a.ResourceName]; ok {
+				if _, ok := c.entries[k]; !ok {
+					untracked[a.ResourceName]++
+				}
+			}
+		}
+	}
+
+	changed := false
+	for _, e := range c.uniqueEntries() {
+		a := findAssignment(assigned, e)
+		switch {
+		case a != nil:
+			if e.Namespace != a.Namespace || e.Pod != a.Pod || e.Container != a.Container {
+				e.Namespace, e.Pod, e.Container = a.Namespace, a.Pod, a.Container
+				changed = true
+			}
+		case time.Since(e.Time) < gracePeriod:
+			// the kubelet might not report the assignment yet
+		case e.assigned():
+			c.l.Debug("Removing released allocation from checkpoint", zap.String("resourceName", e.ResourceName), zap.Strings("deviceIDs", e.DeviceIDs),
+				zap.String("namespace", e.Namespace), zap.String("pod", e.Pod), zap.String("container", e.Container))
+			c.remove(e)
+			changed = true
+		default:
+			c.l.Warn("Orphaned allocation, the devices were never assigned to a container", zap.String("resourceName", e.ResourceName),
+				zap.Strings("deviceIDs", e.DeviceIDs), zap.Time("allocated", e.Time))
+			metrics.OrphanedAllocations.WithLabelValues(e.ResourceName).Inc()
+			c.remove(e)
+			changed = true
+		}
+	}
+
+	metrics.UntrackedAllocations.Reset()
+	for resourceName, n := range untracked {
+		c.l.Debug("Devices are assigned, but not in the checkpoint", zap.String("resourceName", resourceName), zap.Int("devices", n))
+		metrics.UntrackedAllocations.WithLabelValues(resourceName).Set(float64(n))
+	}
+	if changed {
+		c.save()
+	}
+	return nil
+}
+
+func findAssignment(assigned map[key]*podresources.Assignment, e *Entry) *podresources.Assignment {
+	for _, id := range e.DeviceIDs {
+		if a, ok := assigned[key{resourceName: e.ResourceName, deviceID: id}]; ok {
+			return a
+		}
+	}
+	return nil
+}
+
+// uniqueEntries returns every entry once, sorted by time
+func (c *Checkpoint) uniqueEntries() []*Entry {
+	seen := make(map[*Entry]struct{}, len(c.entries))
+	ret := make([]*Entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		if _, ok := seen[e]; ok {
+			continue
+		}
+		seen[e] = struct{}{}
+		ret = append(ret, e)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret
+}
+
+// save writes the checkpoint atomically, so that a crash never leaves a partial checkpoint behind.
+// Errors are only logged, as the checkpoint must never fail an allocation.
+func (c *Checkpoint) save() {
+	c.updateMetrics()
+	b, err := json.MarshalIndent(&file{Version: version, Entries: c.uniqueEntries()}, "", "  ")
+	if err != nil {
+		c.l.Error("Marshaling checkpoint failed", zap.Error(err))
+		return
+	}
+	if err := writeFile(c.path, b); err != nil {
+		c.l.Error("Writing checkpoint failed", zap.Error(err))
+	}
+}
+
+// writeFile replaces the file at the given path atomically. The data is synced to disk before the rename,
+// and the directory afterwards, so that neither an empty file nor the old one reappear after a power loss.
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close() // nolint: errcheck
+		return fmt.Errorf("syncing %s: %w", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close() // nolint: errcheck
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", filepath.Dir(path), err)
+	}
+	return nil
+}
+
+func (c *Checkpoint) updateMetrics() {
+	metrics.CheckpointAllocations.Reset()
+	for _, e := range c.uniqueEntries() {
+		metrics.CheckpointAllocations.WithLabelValues(e.ResourceName).Inc()
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checkpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/podresources"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	tpmrm = "githedgehog.com/tpmrm"
+	tpm   = "githedgehog.com/tpm"
+)
+
+// fakeKubelet serves the PodResources API with the configured pods
+type fakeKubelet struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	mu   sync.Mutex
+	pods []*podresourcesapi.PodResources
+}
+
+func (k *fakeKubelet) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: k.pods}, nil
+}
+
+func (k *fakeKubelet) setPods(pods ...*podresourcesapi.PodResources) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pods = pods
+}
+
+// startFakeKubelet serves the fake PodResources API on a unix socket, and returns a client for it
+func startFakeKubelet(t *testing.T) (*fakeKubelet, *podresources.Client) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "kubelet.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listening on %s: %v", socket, err)
+	}
+	k := &fakeKubelet{}
+	srv := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(srv, k)
+	go srv.Serve(lis) // nolint: errcheck
+	t.Cleanup(srv.Stop)
+	return k, podresources.New(socket)
+}
+
+func pod(namespace, name, container, resourceName string, deviceIDs ...string) *podresourcesapi.PodResources {
+	return &podresourcesapi.PodResources{
+		Namespace: namespace,
+		Name:      name,
+		Containers: []*podresourcesapi.ContainerResources{
+			{
+				Name: container,
+				Devices: []*podresourcesapi.ContainerDevices{
+					{ResourceName: resourceName, DeviceIds: deviceIDs},
+				},
+			},
+		},
+	}
+}
+
+// writeCheckpoint writes a checkpoint file with the given entries into the state directory
+func writeCheckpoint(t *testing.T, stateDir string, entries ...*Entry) {
+	t.Helper()
+	b, err := json.Marshal(&file{Version: version, Entries: entries})
+	if err != nil {
+		t.Fatalf("marshaling checkpoint: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, FileName), b, 0o600); err != nil {
+		t.Fatalf("writing checkpoint: %v", err)
+	}
+}
+
+// loadEntries returns the entries of the checkpoint file by their first device ID
+func loadEntries(t *testing.T, stateDir string) map[string]*Entry {
+	t.Helper()
+	entries, err := load(filepath.Join(stateDir, FileName))
+	if err != nil {
+		t.Fatalf("loading checkpoint: %v", err)
+	}
+	ret := make(map[string]*Entry, len(entries))
+	for _, e := range entries {
+		ret[e.DeviceIDs[0]] = e
+	}
+	return ret
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{name: "missing"},
+		{name: "empty entries", content: `{"version":1,"entries":[]}`},
+		{name: "entries", content: `{"version":1,"entries":[{"resourceName":"githedgehog.com/tpmrm","deviceIDs":["tpmrm0-1"]},{"resourceName":"githedgehog.com/tpm","deviceIDs":["tpm0"]}]}`, want: 2},
+		{name: "corrupt", content: `{"version":1,"entries":[`, wantErr: true},
+		{name: "unsupported version", content: `{"version":2,"entries":[]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), FileName)
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+					t.Fatalf("writing checkpoint: %v", err)
+				}
+			}
+			entries, err := load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(entries) != tt.want {
+				t.Errorf("expected %d entries, got %d", tt.want, len(entries))
+			}
+		})
+	}
+}
+
+func TestNewReplacesCorruptCheckpoint(t *testing.T) {
+	stateDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stateDir, FileName), []byte("{"), 0o600); err != nil {
+		t.Fatalf("writing checkpoint: %v", err)
+	}
+	c, err := New(zap.NewNop(), stateDir, []string{tpmrm}, nil)
+	if err != nil {
+		t.Fatalf("a corrupt checkpoint must not fail: %v", err)
+	}
+	c.Record(tpmrm, []string{"tpmrm0-1"}, &pluginapi.ContainerAllocateResponse{})
+	if entries := loadEntries(t, stateDir); len(entries) != 1 {
+		t.Errorf("expected the corrupt checkpoint to be replaced with 1 entry, got %d", len(entries))
+	}
+}
+
+func TestRecord(t *testing.T) {
+	stateDir := t.TempDir()
+	c, err := New(zap.NewNop(), stateDir, []string{tpmrm}, nil)
+	if err != nil {
+		t.Fatalf("creating checkpoint: %v", err)
+	}
+	c.Record(tpmrm, []string{"tpmrm0-1", "tpmrm0-2"}, &pluginapi.ContainerAllocateResponse{Envs: map[string]string{"TPM_DEVICE": "/dev/tpmrm0"}})
+	c.Record(tpmrm, []string{"tpmrm0-3"}, &pluginapi.ContainerAllocateResponse{})
+	// the kubelet reallocates a released device, which replaces the whole earlier allocation
+	c.Record(tpmrm, []string{"tpmrm0-2"}, &pluginapi.ContainerAllocateResponse{})
+
+	entries := loadEntries(t, stateDir)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %v", len(entries), entries)
+	}
+	if _, ok := entries["tpmrm0-1"]; ok {
+		t.Error("expected the replaced allocation to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, FileName+".tmp")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no temporary file to be left behind, got: %v", err)
+	}
+
+	// the next run of the plugin starts with the recorded allocations
+	c, err = New(zap.NewNop(), stateDir, []string{tpmrm}, nil)
+	if err != nil {
+		t.Fatalf("creating checkpoint again: %v", err)
+	}
+	if n := len(c.uniqueEntries()); n != 2 {
+		t.Errorf("expected 2 loaded entries, got %d", n)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	stateDir := t.TempDir()
+	old := time.Now().Add(-2 * gracePeriod)
+	writeCheckpoint(t, stateDir,
+		// allocated and now reported by the kubelet
+		&Entry{Time: old, ResourceName: tpmrm, DeviceIDs: []string{"tpmrm0-1"}},
+		// assigned to a container which is gone now
+		&Entry{Time: old, ResourceName: tpmrm, DeviceIDs: []string{"tpmrm0-2"}, Namespace: "default", Pod: "gone", Container: "app"},
+		// never assigned to a container
+		&Entry{Time: old, ResourceName: tpm, DeviceIDs: []string{"tpm0"}},
+		// allocated just now, the kubelet might not report it yet
+		&Entry{Time: time.Now(), ResourceName: tpmrm, DeviceIDs: []string{"tpmrm0-3"}},
+	)
+	kubelet, client := startFakeKubelet(t)
+	kubelet.setPods(
+		pod("default", "running", "app", tpmrm, "tpmrm0-1"),
+		// not in the checkpoint
+		pod("default", "other", "app", tpmrm, "tpmrm0-4", "tpmrm0-5"),
+		// not a resource of this plugin
+		pod("default", "gpu", "app", "example.com/gpu", "gpu0"),
+	)
+
+	c, err := New(zap.NewNop(), stateDir, []string{tpmrm, tpm}, client)
+	if err != nil {
+		t.Fatalf("creating checkpoint: %v", err)
+	}
+	orphaned := testutil.ToFloat64(metrics.OrphanedAllocations.WithLabelValues(tpm))
+	if err := c.Reconcile(context.Background()); err != nil {
+		t.Fatalf("reconciling: %v", err)
+	}
+
+	entries := loadEntries(t, stateDir)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries after reconciling, got %d: %v", len(entries), entries)
+	}
+	if e := entries["tpmrm0-1"]; e == nil || e.Namespace != "default" || e.Pod != "running" || e.Container != "app" {
+		t.Errorf("expected the allocation to be resolved to its container, got %+v", e)
+	}
+	if _, ok := entries["tpmrm0-3"]; !ok {
+		t.Error("expected the new allocation to be kept during the grace period")
+	}
+	if got := testutil.ToFloat64(metrics.OrphanedAllocations.WithLabelValues(tpm)) - orphaned; got != 1 {
+		t.Errorf("expected 1 orphaned allocation, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.UntrackedAllocations.WithLabelValues(tpmrm)); got != 2 {
+		t.Errorf("expected 2 untracked devices, got %v", got)
+	}
+	if got := testutil.CollectAndCount(metrics.UntrackedAllocations); got != 1 {
+		t.Errorf("expected untracked devices only for the resources of the plugin, got %d series", got)
+	}
+
+	// the pod of the resolved allocation is gone now
+	kubelet.setPods()
+	if err := c.Reconcile(context.Background()); err != nil {
+		t.Fatalf("reconciling again: %v", err)
+	}
+	entries = loadEntries(t, stateDir)
+	if _, ok := entries["tpmrm0-1"]; ok || len(entries) != 1 {
+		t.Errorf("expected only the new allocation to be left, got %v", entries)
+	}
+}
+
+func TestReconcileKubeletUnavailable(t *testing.T) {
+	stateDir := t.TempDir()
+	writeCheckpoint(t, stateDir, &Entry{Time: time.Now().Add(-2 * gracePeriod), ResourceName: tpm, DeviceIDs: []string{"tpm0"}})
+	c, err := New(zap.NewNop(), stateDir, []string{tpm}, podresources.New(filepath.Join(t.TempDir(), "kubelet.sock")))
+	if err != nil {
+		t.Fatalf("creating checkpoint: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Reconcile(ctx); err == nil {
+		t.Fatal("expected an error without the kubelet")
+	}
+	if entries := loadEntries(t, stateDir); len(entries) != 1 {
+		t.Errorf("expected the checkpoint to be unchanged, got %v", entries)
+	}
+}
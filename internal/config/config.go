@@ -0,0 +1,563 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config holds the configuration file of the TPM device plugin. The configuration defines which
+// resources are being advertised to the kubelet. Every resource is served by its own device plugin instance
+// with its own socket, and several resources can expose the same TPM device under different names.
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Kind is the kind of TPM device that a resource exposes
+type Kind string
+
+const (
+	// KindTPMRM exposes the /dev/tpmrm0 device which uses the in-kernel resource manager,
+	// and can be shared between many containers
+	KindTPMRM Kind = "tpmrm"
+	// KindTPM exposes the /dev/tpm0 device which can only be used by one container at a time
+	KindTPM Kind = "tpm"
+	// KindTPM12 exposes the /dev/tpm0 device like KindTPM, but only if it is a TPM 1.2
+	KindTPM12 Kind = "tpm12"
+	// KindSimulator exposes a TPM simulator (swtpm or mssim) for development clusters without a TPM,
+	// and can be shared between many containers
+	KindSimulator Kind = "simulator"
+)
+
+const (
+	// TPMRMDevicePath is the default device of the tpmrm kind
+	TPMRMDevicePath = "/dev/tpmrm0"
+	// TPMDevicePath is the default device of the tpm and tpm12 kinds
+	TPMDevicePath = "/dev/tpm0"
+	// SimulatorContainerPath is the default path of the unix socket of a simulator in containers
+	SimulatorContainerPath = "/var/run/tpm/tpm.sock"
+)
+
+// DefaultDevicePath returns the device on the host that a resource of this kind exposes by default.
+// Simulators do not have a device.
+func (k Kind) DefaultDevicePath() string {
+	switch k {
+	case KindTPMRM:
+		return TPMRMDevicePath
+	case KindSimulator:
+		return ""
+	default:
+		return TPMDevicePath
+	}
+}
+
+// SimulatorType is the protocol of a TPM simulator, it decides the TCTI that containers use
+type SimulatorType string
+
+const (
+	// SimulatorTypeSWTPM is the swtpm simulator which uses the swtpm TCTI
+	SimulatorTypeSWTPM SimulatorType = "swtpm"
+	// SimulatorTypeMSSIM is the Microsoft reference simulator (or swtpm in its mssim mode) which uses the mssim TCTI
+	SimulatorTypeMSSIM SimulatorType = "mssim"
+)
+
+func (t SimulatorType) validate() error {
+	switch t {
+	case SimulatorTypeSWTPM, SimulatorTypeMSSIM:
+		return nil
+	default:
+		return fmt.Errorf("unsupported simulator type '%s', must be one of: %s, %s", t, SimulatorTypeSWTPM, SimulatorTypeMSSIM)
+	}
+}
+
+// TPM12Policy decides what happens to a tpmrm resource on a node with a TPM 1.2
+// which is not supported by the in-kernel resource manager
+type TPM12Policy string
+
+const (
+	// TPM12PolicyRefuse does not start the device plugin
+	TPM12PolicyRefuse TPM12Policy = "refuse"
+	// TPM12PolicyUnhealthy starts the device plugin, but advertises all devices as unhealthy
+	TPM12PolicyUnhealthy TPM12Policy = "unhealthy"
+)
+
+// ParseTPM12Policy parses a TPM 1.2 policy as it is being passed on the command-line
+func ParseTPM12Policy(s string) (TPM12Policy, error) {
+	p := TPM12Policy(s)
+	if err := p.validate(); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+func (p TPM12Policy) validate() error {
+	switch p {
+	case TPM12PolicyRefuse, TPM12PolicyUnhealthy:
+		return nil
+	default:
+		return fmt.Errorf("unsupported TPM 1.2 policy '%s', must be one of: %s, %s", p, TPM12PolicyRefuse, TPM12PolicyUnhealthy)
+	}
+}
+
+// Mode decides if the device plugin for a resource is being started
+type Mode string
+
+const (
+	// ModeEnabled always starts the device plugin
+	ModeEnabled Mode = "enabled"
+	// ModeDisabled never starts the device plugin
+	ModeDisabled Mode = "disabled"
+	// ModeAuto only starts the device plugin if the device that it exposes exists on the node
+	ModeAuto Mode = "auto"
+)
+
+// ParseMode parses a mode as it is being passed on the command-line
+func ParseMode(s string) (Mode, error) {
+	m := Mode(s)
+	if err := m.validate(); err != nil {
+		return "", err
+	}
+	return m, nil
+}
+
+func (m Mode) validate() error {
+	switch m {
+	case ModeEnabled, ModeDisabled, ModeAuto:
+		return nil
+	default:
+		return fmt.Errorf("unsupported mode '%s', must be one of: %s, %s, %s", m, ModeEnabled, ModeDisabled, ModeAuto)
+	}
+}
+
+// Config is the configuration file of the TPM device plugin
+type Config struct {
+	Resources []*Resource `json:"resources"`
+}
+
+// Resource configures a single resource which is advertised to the kubelet
+type Resource struct {
+	// Name is the name of the device plugin instance which is used in logs, defaults to the kind
+	Name string `json:"name,omitempty"`
+	// Kind is the kind of TPM device that this resource exposes
+	Kind Kind `json:"kind"`
+	// Mode decides if the device plugin for this resource is being started, defaults to enabled
+	Mode Mode `json:"mode,omitempty"`
+	// ResourceName is the extended resource name that pods request, e.g. 'githedgehog.com/tpmrm'
+	ResourceName string `json:"resourceName"`
+	// SocketName is the name of the unix socket of the device plugin instance in the kubelet device plugin directory
+	SocketName string `json:"socketName"`
+	// NumDevices is the number of artificial devices to advertise, only supported for the tpmrm and simulator kinds
+	NumDevices uint `json:"numDevices,omitempty"`
+	// Envs are additional environment variables which are passed to containers that were allocated this resource,
+	// the placeholder $(TPM_DEVICE) in their values is replaced with the container path of the device
+	Envs map[string]string `json:"envs,omitempty"`
+	// PassTPM2ToolsTCTIEnvVar passes a TPM2TOOLS_TCTI environment variable which points to the device to containers
+	PassTPM2ToolsTCTIEnvVar bool `json:"passTPM2ToolsTCTIEnvVar,omitempty"`
+	// TPM12Policy decides what happens on a node with a TPM 1.2, only supported for the tpmrm kind, defaults to refuse
+	TPM12Policy TPM12Policy `json:"tpm12Policy,omitempty"`
+	// DevicePath is the device on the host which is passed into containers, defaults to /dev/tpmrm0 for
+	// the tpmrm kind, and to /dev/tpm0 for the tpm and tpm12 kinds
+	DevicePath string `json:"devicePath,omitempty"`
+	// ContainerPath is the path of the device in containers, defaults to the device path. This allows to
+	// present e.g. /dev/tpmrm1 as /dev/tpmrm0, or /dev/tpmrm0 as /dev/tpm0 to software which insists on it.
+	// For the simulator kind the directory of the simulator socket is mounted at its directory, and the socket
+	// keeps its name, defaults to /var/run/tpm/tpm.sock.
+	ContainerPath string `json:"containerPath,omitempty"`
+	// Permissions are the cgroup device permissions for the device in containers, any combination of
+	// r (read), w (write) and m (mknod), defaults to rwm
+	Permissions string `json:"permissions,omitempty"`
+	// Policy restricts which pods can use the devices of this resource, all pods can use them if it is not set
+	Policy *Policy `json:"policy,omitempty"`
+	// CDI passes the device as a CDI device instead which allows to set its owner and mode in containers
+	CDI *CDI `json:"cdi,omitempty"`
+	// Proxy passes a unix socket to containers instead of the device, only supported for the tpmrm kind.
+	// The plugin forwards the commands from the socket to the device, and limits every allocation.
+	Proxy *Proxy `json:"proxy,omitempty"`
+	// Simulator configures the TPM simulator, required for the simulator kind
+	Simulator *Simulator `json:"simulator,omitempty"`
+}
+
+// Simulator configures how containers reach a TPM simulator. Exactly one of the socket and the address must be set.
+type Simulator struct {
+	// Type is the protocol of the simulator, defaults to swtpm
+	Type SimulatorType `json:"type,omitempty"`
+	// Socket is the unix socket of the simulator on the host, its directory is mounted into containers
+	Socket string `json:"socket,omitempty"`
+	// Address is the TCP address of the simulator in the form 'host:port', it must be reachable from containers
+	Address string `json:"address,omitempty"`
+}
+
+// Proxy configures the proxy-based access mode and the limits of every allocation in it
+type Proxy struct {
+	// CommandsPerSecond is the rate at which every allocation can send TPM commands, unlimited if 0
+	CommandsPerSecond float64 `json:"commandsPerSecond,omitempty"`
+	// Burst is the number of TPM commands which every allocation can send at once, defaults to 1
+	// if the commands per second are limited
+	Burst int `json:"burst,omitempty"`
+	// MaxSessions is the number of concurrent connections of every allocation, unlimited if 0
+	MaxSessions int `json:"maxSessions,omitempty"`
+}
+
+// Policy restricts which pods can use the devices of a resource.
+// A pod is allowed if either its namespace or its service account is listed.
+type Policy struct {
+	// Namespaces are the namespaces whose pods are allowed
+	Namespaces []string `json:"namespaces,omitempty"`
+	// ServiceAccounts are the service accounts of the form 'namespace/name' whose pods are allowed
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+}
+
+// Validate ensures that the policy allows at least one namespace or service account, and that all service accounts are valid
+func (p *Policy) Validate() error {
+	if len(p.Namespaces) == 0 && len(p.ServiceAccounts) == 0 {
+		return fmt.Errorf("policy must allow at least one namespace or service account")
+	}
+	for _, ns := range p.Namespaces {
+		if ns == "" {
+			return fmt.Errorf("policy namespaces must not be empty")
+		}
+	}
+	for _, sa := range p.ServiceAccounts {
+		ns, name, ok := strings.Cut(sa, "/")
+		if !ok || ns == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("policy service account '%s' must be of the form 'namespace/name'", sa)
+		}
+	}
+	return nil
+}
+
+// CDI configures the device node of a resource which is passed as a CDI device. Unset settings are
+// taken from the device node on the host by the container runtime.
+type CDI struct {
+	// UID is the owner of the device node in containers
+	UID *uint32 `json:"uid,omitempty"`
+	// GID is the group of the device node in containers
+	GID *uint32 `json:"gid,omitempty"`
+	// FileMode is the file mode of the device node in containers in octal notation, e.g. "0660"
+	FileMode string `json:"fileMode,omitempty"`
+}
+
+// ParseFileMode returns the parsed file mode, or nil if it is not set
+func (c *CDI) ParseFileMode() (*os.FileMode, error) {
+	if c.FileMode == "" {
+		return nil, nil
+	}
+	m, err := strconv.ParseUint(c.FileMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("file mode '%s' must be in octal notation: %w", c.FileMode, err)
+	}
+	mode := os.FileMode(m)
+	if mode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("file mode '%s' must only contain permission bits", c.FileMode)
+	}
+	return &mode, nil
+}
+
+// Defaults are the settings of the default resources which can be changed on the command-line
+type Defaults struct {
+	NumTPMRMDevices         uint
+	PassTPM2ToolsTCTIEnvVar bool
+	TPMRMMode               Mode
+	TPMMode                 Mode
+	TPM12Mode               Mode
+	TPM12Policy             TPM12Policy
+	TPMPolicy               *Policy
+}
+
+// Default returns the configuration which is used when no configuration file is given. It reproduces
+// the classic behaviour of the plugin: one 'githedgehog.com/tpmrm' and one 'githedgehog.com/tpm' resource.
+// Additionally there is a 'githedgehog.com/tpm12' resource which needs to be enabled explicitly.
+func Default(d Defaults) *Config {
+	return &Config{
+		Resources: []*Resource{
+			{
+				Name:                    "tpmrm",
+				Kind:                    KindTPMRM,
+				Mode:                    d.TPMRMMode,
+				ResourceName:            "githedgehog.com/tpmrm",
+				SocketName:              "hh-tpmrm.sock",
+				NumDevices:              d.NumTPMRMDevices,
+				PassTPM2ToolsTCTIEnvVar: d.PassTPM2ToolsTCTIEnvVar,
+				TPM12Policy:             d.TPM12Policy,
+				DevicePath:              TPMRMDevicePath,
+				ContainerPath:           TPMRMDevicePath,
+				Permissions:             "rwm",
+			},
+			{
+				Name:                    "tpm",
+				Kind:                    KindTPM,
+				Mode:                    d.TPMMode,
+				ResourceName:            "githedgehog.com/tpm",
+				SocketName:              "hh-tpm.sock",
+				PassTPM2ToolsTCTIEnvVar: d.PassTPM2ToolsTCTIEnvVar,
+				Policy:                  d.TPMPolicy,
+				DevicePath:              TPMDevicePath,
+				ContainerPath:           TPMDevicePath,
+				Permissions:             "rwm",
+			},
+			{
+				Name:          "tpm12",
+				Kind:          KindTPM12,
+				Mode:          d.TPM12Mode,
+				ResourceName:  "githedgehog.com/tpm12",
+				SocketName:    "hh-tpm12.sock",
+				DevicePath:    TPMDevicePath,
+				ContainerPath: TPMDevicePath,
+				Permissions:   "rwm",
+			},
+		},
+	}
+}
+
+// Load reads, defaults and validates the configuration file at the given path
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file %s: %w", path, err)
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) setDefaults() {
+	for _, r := range c.Resources {
+		if r.Name == "" {
+			r.Name = string(r.Kind)
+		}
+		if r.Mode == "" {
+			r.Mode = ModeEnabled
+		}
+		if (r.Kind == KindTPMRM || r.Kind == KindSimulator) && r.NumDevices == 0 {
+			r.NumDevices = 64
+		}
+		if r.Kind == KindTPMRM && r.TPM12Policy == "" {
+			r.TPM12Policy = TPM12PolicyRefuse
+		}
+		if r.DevicePath == "" {
+			r.DevicePath = r.Kind.DefaultDevicePath()
+		}
+		if r.ContainerPath == "" {
+			r.ContainerPath = r.DevicePath
+			if r.Kind == KindSimulator {
+				r.ContainerPath = SimulatorContainerPath
+			}
+		}
+		if r.Permissions == "" {
+			r.Permissions = "rwm"
+		}
+		if r.Simulator != nil && r.Simulator.Type == "" {
+			r.Simulator.Type = SimulatorTypeSWTPM
+		}
+		if r.Proxy != nil && r.Proxy.CommandsPerSecond > 0 && r.Proxy.Burst == 0 {
+			r.Proxy.Burst = 1
+		}
+	}
+}
+
+// Validate ensures that all resources are valid, and that they do not conflict with each other
+func (c *Config) Validate() error {
+	if len(c.Resources) == 0 {
+		return fmt.Errorf("no resources configured")
+	}
+	names := make(map[string]struct{}, len(c.Resources))
+	resourceNames := make(map[string]struct{}, len(c.Resources))
+	socketNames := make(map[string]struct{}, len(c.Resources))
+	// the kubelet hands out the devices of every resource independently, so two resources of an exclusive kind
+	// would pass the same device to two containers at once
+	// NOTE: the tpm and tpm12 kinds can share a device as they are never enabled on the same node
+	exclusiveDevices := make(map[string]string, len(c.Resources))
+	for i, r := range c.Resources {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("resource %d: %w", i, err)
+		}
+		if _, ok := names[r.Name]; ok {
+			return fmt.Errorf("resource %d: duplicate name %s", i, r.Name)
+		}
+		names[r.Name] = struct{}{}
+		if _, ok := resourceNames[r.ResourceName]; ok {
+			return fmt.Errorf("resource %d: duplicate resource name %s", i, r.ResourceName)
+		}
+		resourceNames[r.ResourceName] = struct{}{}
+		if _, ok := socketNames[r.SocketName]; ok {
+			return fmt.Errorf("resource %d: duplicate socket name %s", i, r.SocketName)
+		}
+		socketNames[r.SocketName] = struct{}{}
+		if (r.Kind == KindTPM || r.Kind == KindTPM12) && r.Mode != ModeDisabled {
+			key := string(r.Kind) + ":" + r.DevicePath
+			if other, ok := exclusiveDevices[key]; ok {
+				return fmt.Errorf("resource %d: %s: device %s is already exclusively used by resource %s", i, r.Name, r.DevicePath, other)
+			}
+			exclusiveDevices[key] = r.Name
+		}
+	}
+	return nil
+}
+
+// HasServiceAccountPolicy returns true if any resource has a policy which allows service accounts.
+// Policies with service accounts need to look up pods in the Kubernetes API.
+func (c *Config) HasServiceAccountPolicy() bool {
+	for _, r := range c.Resources {
+		if r.Policy != nil && len(r.Policy.ServiceAccounts) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Resource) validate() error {
+	if err := r.Mode.validate(); err != nil {
+		return fmt.Errorf("%s: %w", r.Name, err)
+	}
+	switch r.Kind {
+	case KindTPMRM:
+		if r.NumDevices == 0 {
+			return fmt.Errorf("%s: number of devices must be greater than 0", r.Name)
+		}
+		if err := r.TPM12Policy.validate(); err != nil {
+			return fmt.Errorf("%s: %w", r.Name, err)
+		}
+	case KindTPM, KindTPM12:
+		if r.NumDevices > 1 {
+			return fmt.Errorf("%s: kind %s only supports a single device", r.Name, r.Kind)
+		}
+		if r.TPM12Policy != "" {
+			return fmt.Errorf("%s: kind %s does not support a TPM 1.2 policy", r.Name, r.Kind)
+		}
+		if r.Kind == KindTPM12 && r.PassTPM2ToolsTCTIEnvVar {
+			return fmt.Errorf("%s: kind %s does not support the TPM2TOOLS_TCTI environment variable", r.Name, r.Kind)
+		}
+	case KindSimulator:
+		if r.NumDevices == 0 {
+			return fmt.Errorf("%s: number of devices must be greater than 0", r.Name)
+		}
+		if r.TPM12Policy != "" {
+			return fmt.Errorf("%s: kind %s does not support a TPM 1.2 policy", r.Name, r.Kind)
+		}
+		if err := r.Simulator.validate(); err != nil {
+			return fmt.Errorf("%s: simulator: %w", r.Name, err)
+		}
+		if r.CDI != nil {
+			return fmt.Errorf("%s: kind %s does not pass a device, it cannot be combined with cdi", r.Name, r.Kind)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported kind '%s'", r.Name, r.Kind)
+	}
+	// extended resource names must be of the form 'domain/name', and the domain must not be a kubernetes one
+	domain, name, ok := strings.Cut(r.ResourceName, "/")
+	if !ok || domain == "" || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("%s: resource name '%s' must be of the form 'domain/name'", r.Name, r.ResourceName)
+	}
+	if domain == "kubernetes.io" || strings.HasSuffix(domain, ".kubernetes.io") {
+		return fmt.Errorf("%s: resource name '%s' must not use a kubernetes.io domain", r.Name, r.ResourceName)
+	}
+	if r.SocketName == "" || strings.ContainsRune(r.SocketName, os.PathSeparator) {
+		return fmt.Errorf("%s: socket name '%s' must be a file name", r.Name, r.SocketName)
+	}
+	if r.Policy != nil {
+		if err := r.Policy.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", r.Name, err)
+		}
+	}
+	if r.Kind != KindSimulator {
+		if err := validateDevicePath(r.DevicePath); err != nil {
+			return fmt.Errorf("%s: device path: %w", r.Name, err)
+		}
+	} else if r.DevicePath != "" {
+		return fmt.Errorf("%s: kind %s does not support a device path, the simulator is configured in its own section", r.Name, r.Kind)
+	}
+	if err := validateDevicePath(r.ContainerPath); err != nil {
+		return fmt.Errorf("%s: container path: %w", r.Name, err)
+	}
+	if err := validatePermissions(r.Permissions); err != nil {
+		return fmt.Errorf("%s: %w", r.Name, err)
+	}
+	if r.CDI != nil {
+		if _, err := r.CDI.ParseFileMode(); err != nil {
+			return fmt.Errorf("%s: cdi: %w", r.Name, err)
+		}
+	}
+	if r.Simulator != nil && r.Kind != KindSimulator {
+		return fmt.Errorf("%s: kind %s does not support a simulator", r.Name, r.Kind)
+	}
+	if r.Proxy != nil {
+		if r.Kind != KindTPMRM {
+			return fmt.Errorf("%s: kind %s does not support the proxy", r.Name, r.Kind)
+		}
+		if r.CDI != nil {
+			return fmt.Errorf("%s: the proxy does not pass a device, it cannot be combined with cdi", r.Name)
+		}
+		if r.Proxy.CommandsPerSecond < 0 || r.Proxy.Burst < 0 || r.Proxy.MaxSessions < 0 {
+			return fmt.Errorf("%s: proxy limits must not be negative", r.Name)
+		}
+	}
+	return nil
+}
+
+func (s *Simulator) validate() error {
+	// caller safeguard
+	if s == nil {
+		return fmt.Errorf("must be set")
+	}
+	if err := s.Type.validate(); err != nil {
+		return err
+	}
+	if (s.Socket == "") == (s.Address == "") {
+		return fmt.Errorf("exactly one of socket and address must be set")
+	}
+	if s.Socket != "" {
+		if err := validateDevicePath(s.Socket); err != nil {
+			return fmt.Errorf("socket: %w", err)
+		}
+	}
+	if s.Address != "" {
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			return fmt.Errorf("address: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateDevicePath ensures that a device path is absolute and clean
+func validateDevicePath(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("'%s' must be an absolute and clean path", path)
+	}
+	return nil
+}
+
+// validatePermissions ensures that the cgroup device permissions are a combination of r, w and m
+func validatePermissions(permissions string) error {
+	if permissions == "" {
+		return fmt.Errorf("permissions must not be empty")
+	}
+	for i, c := range permissions {
+		if !strings.ContainsRune("rwm", c) || strings.ContainsRune(permissions[i+1:], c) {
+			return fmt.Errorf("permissions '%s' must be a combination of r, w and m", permissions)
+		}
+	}
+	return nil
+}
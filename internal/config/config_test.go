@@ -0,0 +1,279 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testDefaults() Defaults {
+	return Defaults{
+		TPMRMMode:       ModeEnabled,
+		TPMMode:         ModeEnabled,
+		TPM12Mode:       ModeDisabled,
+		TPM12Policy:     TPM12PolicyRefuse,
+		NumTPMRMDevices: 64,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{
+			name:   "default",
+			modify: func(c *Config) {},
+		},
+		{
+			name:    "no resources",
+			modify:  func(c *Config) { c.Resources = nil },
+			wantErr: "no resources configured",
+		},
+		{
+			name: "duplicate name",
+			modify: func(c *Config) {
+				c.Resources[1].Name = "tpmrm"
+			},
+			wantErr: "duplicate name tpmrm",
+		},
+		{
+			name: "duplicate resource name",
+			modify: func(c *Config) {
+				c.Resources[1].ResourceName = "githedgehog.com/tpmrm"
+			},
+			wantErr: "duplicate resource name githedgehog.com/tpmrm",
+		},
+		{
+			name: "duplicate socket name",
+			modify: func(c *Config) {
+				c.Resources[1].SocketName = "hh-tpmrm.sock"
+			},
+			wantErr: "duplicate socket name hh-tpmrm.sock",
+		},
+		{
+			name: "exclusive device used twice",
+			modify: func(c *Config) {
+				c.Resources = append(c.Resources, &Resource{
+					Name:          "tpm-2",
+					Kind:          KindTPM,
+					Mode:          ModeAuto,
+					ResourceName:  "example.com/tpm",
+					SocketName:    "example-tpm.sock",
+					DevicePath:    TPMDevicePath,
+					ContainerPath: TPMDevicePath,
+					Permissions:   "rw",
+				})
+			},
+			wantErr: "device /dev/tpm0 is already exclusively used by resource tpm",
+		},
+		{
+			name: "exclusive device used twice with one disabled",
+			modify: func(c *Config) {
+				c.Resources[1].Mode = ModeDisabled
+				c.Resources = append(c.Resources, &Resource{
+					Name:          "tpm-2",
+					Kind:          KindTPM,
+					Mode:          ModeEnabled,
+					ResourceName:  "example.com/tpm",
+					SocketName:    "example-tpm.sock",
+					DevicePath:    TPMDevicePath,
+					ContainerPath: TPMDevicePath,
+					Permissions:   "rw",
+				})
+			},
+		},
+		{
+			name: "tpm and tpm12 share a device",
+			modify: func(c *Config) {
+				c.Resources[2].Mode = ModeEnabled
+			},
+		},
+		{
+			name: "exclusive kinds on different devices",
+			modify: func(c *Config) {
+				c.Resources = append(c.Resources, &Resource{
+					Name:          "tpm1",
+					Kind:          KindTPM,
+					Mode:          ModeEnabled,
+					ResourceName:  "example.com/tpm1",
+					SocketName:    "example-tpm1.sock",
+					DevicePath:    "/dev/tpm1",
+					ContainerPath: TPMDevicePath,
+					Permissions:   "rw",
+				})
+			},
+		},
+		{
+			name: "shared device used twice",
+			modify: func(c *Config) {
+				c.Resources = append(c.Resources, &Resource{
+					Name:          "tpmrm-2",
+					Kind:          KindTPMRM,
+					Mode:          ModeEnabled,
+					ResourceName:  "example.com/tpmrm",
+					SocketName:    "example-tpmrm.sock",
+					NumDevices:    8,
+					TPM12Policy:   TPM12PolicyRefuse,
+					DevicePath:    TPMRMDevicePath,
+					ContainerPath: TPMRMDevicePath,
+					Permissions:   "rw",
+				})
+			},
+		},
+		{
+			name: "unsupported kind",
+			modify: func(c *Config) {
+				c.Resources[0].Kind = "vtpm"
+			},
+			wantErr: "unsupported kind 'vtpm'",
+		},
+		{
+			name: "tpm with several devices",
+			modify: func(c *Config) {
+				c.Resources[1].NumDevices = 2
+			},
+			wantErr: "kind tpm only supports a single device",
+		},
+		{
+			name: "resource name without domain",
+			modify: func(c *Config) {
+				c.Resources[0].ResourceName = "tpmrm"
+			},
+			wantErr: "must be of the form 'domain/name'",
+		},
+		{
+			name: "kubernetes resource name",
+			modify: func(c *Config) {
+				c.Resources[0].ResourceName = "kubernetes.io/tpmrm"
+			},
+			wantErr: "must not use a kubernetes.io domain",
+		},
+		{
+			name: "relative device path",
+			modify: func(c *Config) {
+				c.Resources[0].DevicePath = "dev/tpmrm0"
+			},
+			wantErr: "device path: 'dev/tpmrm0' must be an absolute and clean path",
+		},
+		{
+			name: "invalid permissions",
+			modify: func(c *Config) {
+				c.Resources[0].Permissions = "rwx"
+			},
+			wantErr: "permissions 'rwx' must be a combination of r, w and m",
+		},
+		{
+			name: "proxy on tpm",
+			modify: func(c *Config) {
+				c.Resources[1].Proxy = &Proxy{CommandsPerSecond: 1}
+			},
+			wantErr: "kind tpm does not support the proxy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default(testDefaults())
+			tt.modify(c)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		check   func(t *testing.T, c *Config)
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			config: `
+resources:
+- kind: tpmrm
+  resourceName: example.com/tpmrm
+  socketName: example-tpmrm.sock
+`,
+			check: func(t *testing.T, c *Config) {
+				r := c.Resources[0]
+				if r.Name != "tpmrm" || r.Mode != ModeEnabled || r.NumDevices != 64 || r.TPM12Policy != TPM12PolicyRefuse ||
+					r.DevicePath != TPMRMDevicePath || r.ContainerPath != TPMRMDevicePath || r.Permissions != "rwm" {
+					t.Errorf("unexpected defaults: %+v", r)
+				}
+			},
+		},
+		{
+			name: "exclusive device used twice",
+			config: `
+resources:
+- name: a
+  kind: tpm
+  resourceName: example.com/a
+  socketName: a.sock
+- name: b
+  kind: tpm
+  resourceName: example.com/b
+  socketName: b.sock
+`,
+			wantErr: "device /dev/tpm0 is already exclusively used by resource a",
+		},
+		{
+			name: "unknown field",
+			config: `
+resources:
+- kind: tpmrm
+  resourceName: example.com/tpmrm
+  socketName: example-tpmrm.sock
+  devices: 3
+`,
+			wantErr: "unknown field",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.check(t, c)
+		})
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ek reads the endorsement key certificates and public keys of a TPM 2.0, and caches them in a
+// directory on the host. Attestation agents in pods can read them from there instead of querying the TPM.
+package ek
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// KeyType is the algorithm of an endorsement key
+type KeyType string
+
+const (
+	KeyTypeRSA KeyType = "rsa"
+	KeyTypeECC KeyType = "ecc"
+)
+
+// the NV indices of the EK certificates and the templates of the EKs as defined by the
+// TCG EK Credential Profile for the low range
+var keyTypes = []struct {
+	keyType  KeyType
+	nvIndex  tpm2.TPMHandle
+	template tpm2.TPMTPublic
+}{
+	{KeyTypeRSA, 0x01c00002, tpm2.RSAEKTemplate},
+	{KeyTypeECC, 0x01c0000a, tpm2.ECCEKTemplate},
+}
+
+// nvReadChunkSize is small enough for the maximum NV buffer size of all TPMs
+const nvReadChunkSize = 512
+
+// Key is an endorsement key of a TPM
+type Key struct {
+	Type KeyType
+	// Certificate is the DER encoded EK certificate, nil if the TPM has no certificate for this key
+	Certificate []byte
+	// Public is the DER encoded (PKIX) public key
+	Public []byte
+}
+
+// EK are the endorsement keys of a TPM
+type EK struct {
+	Keys []*Key
+}
+
+// Read reads the endorsement keys from the TPM 2.0 at the given device path. The EKs are recreated
+// from the default templates. Key types which the TPM does not support are skipped.
+func Read(devicePath string) (*EK, error) {
+	t, err := transport.OpenTPM(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening TPM %s: %w", devicePath, err)
+	}
+	defer t.Close() // nolint: errcheck
+
+	ret := &EK{}
+	var errs []error
+	for _, kt := range keyTypes {
+		pub, err := readPublic(t, kt.template)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", kt.keyType, err))
+			continue
+		}
+		cert, err := readCertificate(t, kt.nvIndex)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", kt.keyType, err))
+			continue
+		}
+		ret.Keys = append(ret.Keys, &Key{
+			Type:        kt.keyType,
+			Certificate: cert,
+			Public:      pub,
+		})
+	}
+	if len(ret.Keys) == 0 {
+		return nil, fmt.Errorf("reading endorsement keys: %w", errors.Join(errs...))
+	}
+	return ret, nil
+}
+
+// readPublic creates the EK from the template in the endorsement hierarchy, and returns its DER encoded public key
+func readPublic(t transport.TPM, template tpm2.TPMTPublic) ([]byte, error) {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHEndorsement,
+		InPublic:      tpm2.New2B(template),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("creating EK: %w", err)
+	}
+	defer tpm2.FlushContext{FlushHandle: rsp.ObjectHandle}.Execute(t) // nolint: errcheck
+
+	pub, err := rsp.OutPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("parsing EK public: %w", err)
+	}
+	var key any
+	switch pub.Type {
+	case tpm2.TPMAlgRSA:
+		parms, err := pub.Parameters.RSADetail()
+		if err != nil {
+			return nil, fmt.Errorf("parsing EK public: %w", err)
+		}
+		unique, err := pub.Unique.RSA()
+		if err != nil {
+			return nil, fmt.Errorf("parsing EK public: %w", err)
+		}
+		if key, err = tpm2.RSAPub(parms, unique); err != nil {
+			return nil, fmt.Errorf("parsing EK public: %w", err)
+		}
+	case tpm2.TPMAlgECC:
+		parms, err := pub.Parameters.ECCDetail()
+		if err != nil {
+			return nil, fmt.Errorf("parsing EK public: %w", err)
+		}
+		unique, err := pub.Unique.ECC()
+		if err != nil {
+			return nil, fmt.Errorf("parsing EK public: %w", err)
+		}
+		eccPub, err := tpm2.ECCPub(parms, unique)
+		if err != nil {
+			return nil, fmt.Errorf("parsing EK public: %w", err)
+		}
+		key = &ecdsa.PublicKey{Curve: eccPub.Curve, X: eccPub.X, Y: eccPub.Y}
+	default:
+		return nil, fmt.Errorf("unsupported EK algorithm %d", pub.Type)
+	}
+	return x509.MarshalPKIXPublicKey(key)
+}
+
+// readCertificate reads the EK certificate from the given NV index. It returns nil if the index does not exist.
+func readCertificate(t transport.TPM, index tpm2.TPMHandle) ([]byte, error) {
+	rsp, err := tpm2.NVReadPublic{NVIndex: index}.Execute(t)
+	if err != nil {
+		// most TPMs of virtual machines do not come with EK certificates
+		if errors.Is(err, tpm2.TPMRCHandle) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading NV index %#x: %w", index, err)
+	}
+	nvPub, err := rsp.NVPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("parsing NV index %#x: %w", index, err)
+	}
+
+	b := make([]byte, 0, nvPub.DataSize)
+	for offset := uint16(0); offset < nvPub.DataSize; {
+		size := nvPub.DataSize - offset
+		if size > nvReadChunkSize {
+			size = nvReadChunkSize
+		}
+		data, err := tpm2.NVRead{
+			AuthHandle: tpm2.AuthHandle{
+				Handle: tpm2.TPMRHOwner,
+				Auth:   tpm2.PasswordAuth(nil),
+			},
+			NVIndex: tpm2.NamedHandle{
+				Handle: index,
+				Name:   rsp.NVName,
+			},
+			Size:   size,
+			Offset: offset,
+		}.Execute(t)
+		if err != nil {
+			return nil, fmt.Errorf("reading NV index %#x: %w", index, err)
+		}
+		b = append(b, data.Data.Buffer...)
+		offset += size
+	}
+
+	// the NV index can be larger than the certificate, and vendors pad the rest
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parsing EK certificate in NV index %#x: %w", index, err)
+	}
+	return raw.FullBytes, nil
+}
+
+// AnnotationHash is the node annotation which holds the hash of the primary EK (see EK.Hash)
+const AnnotationHash = "githedgehog.com/tpm-ek-sha256"
+
+// Hash returns the hex encoded SHA-256 hash of the DER encoded public key of the primary EK.
+// The RSA EK is the primary EK if the TPM has one.
+func (e *EK) Hash() string {
+	if len(e.Keys) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(e.Keys[0].Public)
+	return hex.EncodeToString(sum[:])
+}
+
+// the PEM encoded files in the cache directory
+func certificateFile(t KeyType) string { return "ek-" + string(t) + ".crt" }
+func publicFile(t KeyType) string      { return "ek-" + string(t) + ".pub" }
+
+// Write caches the PEM encoded EK certificates and public keys in the given directory
+func (e *EK) Write(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating EK directory: %w", err)
+	}
+	for _, k := range e.Keys {
+		if err := writePEM(filepath.Join(dir, publicFile(k.Type)), "PUBLIC KEY", k.Public); err != nil {
+			return err
+		}
+		if k.Certificate == nil {
+			continue
+		}
+		if err := writePEM(filepath.Join(dir, certificateFile(k.Type)), "CERTIFICATE", k.Certificate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads the EKs which were cached by Write from the given directory
+func Load(dir string) (*EK, error) {
+	ret := &EK{}
+	for _, kt := range keyTypes {
+		pub, err := readPEM(filepath.Join(dir, publicFile(kt.keyType)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cert, err := readPEM(filepath.Join(dir, certificateFile(kt.keyType)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		ret.Keys = append(ret.Keys, &Key{
+			Type:        kt.keyType,
+			Certificate: cert,
+			Public:      pub,
+		})
+	}
+	if len(ret.Keys) == 0 {
+		return nil, fmt.Errorf("no endorsement keys cached in %s", dir)
+	}
+	return ret, nil
+}
+
+// writePEM atomically writes a PEM file, so that containers never read a partial file
+func writePEM(path, blockType string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b}), 0o644); err != nil { // nolint: gosec
+		return fmt.Errorf("writing %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("renaming %s: %w", tmp, err)
+	}
+	return nil
+}
+
+func readPEM(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block.Bytes, nil
+}
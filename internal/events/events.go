@@ -0,0 +1,117 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package events posts Kubernetes events against the node object of the node that the plugin is running on.
+// This makes important state changes of the plugin visible to operators through 'kubectl get events'.
+package events
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Component is the event source component of all events posted by the plugin
+const Component = "k8s-tpm-device-plugin"
+
+// The reasons of all events that are being posted by the plugin
+const (
+	ReasonDeviceUnhealthy    = "TPMDeviceUnhealthy"
+	ReasonDeviceHealthy      = "TPMDeviceHealthy"
+	ReasonRegistrationFailed = "TPMDevicePluginRegistrationFailed"
+	ReasonExclusiveConflict  = "TPMDeviceConflict"
+	ReasonPolicyViolation    = "TPMDevicePolicyViolation"
+)
+
+// Recorder posts events against a node. A nil Recorder is valid and discards all events.
+type Recorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	node        *corev1.ObjectReference
+}
+
+// New creates an event recorder which posts events through the given client against the node with the given name
+func New(client kubernetes.Interface, nodeName string) *Recorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &Recorder{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: Component, Host: nodeName}),
+		// this is how the kubelet references its node in events as well
+		node: &corev1.ObjectReference{
+			Kind: "Node",
+			Name: nodeName,
+			UID:  types.UID(nodeName),
+		},
+	}
+}
+
+// DeviceUnhealthy posts a warning that a TPM device became unhealthy
+func (r *Recorder) DeviceUnhealthy(plugin, device string, err error) {
+	// caller safeguard
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(r.node, corev1.EventTypeWarning, ReasonDeviceUnhealthy, "%s: TPM device %s became unhealthy: %s", plugin, device, err)
+}
+
+// DeviceHealthy posts that a TPM device became healthy (again)
+func (r *Recorder) DeviceHealthy(plugin, device string) {
+	// caller safeguard
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(r.node, corev1.EventTypeNormal, ReasonDeviceHealthy, "%s: TPM device %s became healthy", plugin, device)
+}
+
+// RegistrationFailed posts a warning that a device plugin failed to register with the kubelet
+func (r *Recorder) RegistrationFailed(plugin string, err error) {
+	// caller safeguard
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(r.node, corev1.EventTypeWarning, ReasonRegistrationFailed, "%s: device plugin registration with the kubelet failed: %s", plugin, err)
+}
+
+// ExclusiveConflict posts a warning that a TPM device which is meant for exclusive access is already in use
+func (r *Recorder) ExclusiveConflict(plugin, device string) {
+	// caller safeguard
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(r.node, corev1.EventTypeWarning, ReasonExclusiveConflict, "%s: TPM device %s was allocated to a pod, but it is already in use by another process on the host", plugin, device)
+}
+
+// PolicyViolation posts a warning that a pod which is not allowed to use a TPM device was allocated it
+func (r *Recorder) PolicyViolation(plugin string, err error) {
+	// caller safeguard
+	if r == nil {
+		return
+	}
+	r.recorder.Eventf(r.node, corev1.EventTypeWarning, ReasonPolicyViolation, "%s: refused to start container: %s", plugin, err)
+}
+
+// Shutdown stops posting events
+func (r *Recorder) Shutdown() {
+	// caller safeguard
+	if r == nil {
+		return
+	}
+	r.broadcaster.Shutdown()
+}
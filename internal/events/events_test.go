@@ -0,0 +1,113 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name    string
+		post    func(r *Recorder)
+		typ     string
+		reason  string
+		message string
+	}{
+		{
+			name:    "device unhealthy",
+			post:    func(r *Recorder) { r.DeviceUnhealthy("tpmrm", "/dev/tpmrm0", errors.New("no such device")) },
+			typ:     corev1.EventTypeWarning,
+			reason:  ReasonDeviceUnhealthy,
+			message: "tpmrm: TPM device /dev/tpmrm0 became unhealthy: no such device",
+		},
+		{
+			name:    "device healthy",
+			post:    func(r *Recorder) { r.DeviceHealthy("tpmrm", "/dev/tpmrm0") },
+			typ:     corev1.EventTypeNormal,
+			reason:  ReasonDeviceHealthy,
+			message: "tpmrm: TPM device /dev/tpmrm0 became healthy",
+		},
+		{
+			name:    "registration failed",
+			post:    func(r *Recorder) { r.RegistrationFailed("tpm", errors.New("kubelet down")) },
+			typ:     corev1.EventTypeWarning,
+			reason:  ReasonRegistrationFailed,
+			message: "tpm: device plugin registration with the kubelet failed: kubelet down",
+		},
+		{
+			name:    "exclusive conflict",
+			post:    func(r *Recorder) { r.ExclusiveConflict("tpm", "/dev/tpm0") },
+			typ:     corev1.EventTypeWarning,
+			reason:  ReasonExclusiveConflict,
+			message: "tpm: TPM device /dev/tpm0 was allocated to a pod",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			r := New(client, "node-1")
+			defer r.Shutdown()
+			tt.post(r)
+
+			var events []corev1.Event
+			deadline := time.Now().Add(5 * time.Second)
+			for len(events) == 0 && time.Now().Before(deadline) {
+				list, err := client.CoreV1().Events("").List(context.Background(), metav1.ListOptions{})
+				if err != nil {
+					t.Fatalf("listing events: %v", err)
+				}
+				events = list.Items
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(events) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(events))
+			}
+			e := events[0]
+			if e.InvolvedObject.Kind != "Node" || e.InvolvedObject.Name != "node-1" {
+				t.Errorf("unexpected involved object: %+v", e.InvolvedObject)
+			}
+			if e.Source.Component != Component || e.Source.Host != "node-1" {
+				t.Errorf("unexpected source: %+v", e.Source)
+			}
+			if e.Type != tt.typ || e.Reason != tt.reason {
+				t.Errorf("expected %s/%s, got %s/%s", tt.typ, tt.reason, e.Type, e.Reason)
+			}
+			if !strings.HasPrefix(e.Message, tt.message) {
+				t.Errorf("expected message to start with %q, got %q", tt.message, e.Message)
+			}
+		})
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	var r *Recorder
+	r.DeviceUnhealthy("tpmrm", "/dev/tpmrm0", errors.New("no such device"))
+	r.DeviceHealthy("tpmrm", "/dev/tpmrm0")
+	r.RegistrationFailed("tpm", errors.New("kubelet down"))
+	r.ExclusiveConflict("tpm", "/dev/tpm0")
+	r.PolicyViolation("tpm", errors.New("denied"))
+	r.Shutdown()
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics holds all Prometheus metrics of the TPM device plugin. They are registered with a dedicated
+// registry which is served by the HTTP server of the plugin.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace is the prefix of all metrics of the plugin
+const Namespace = "tpm_device_plugin"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	// BuildInfo reports the version information of the plugin build
+	BuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "build_info",
+		Help:      "The version information of the plugin build. The value is always 1.",
+	}, []string{"version", "git_commit", "git_tree_state", "build_date", "go_version", "device_plugin_api_version"})
+
+	// GRPCDuration measures the unary gRPC calls of the kubelet to the device plugins
+	GRPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "The duration of the unary gRPC calls of the kubelet to the device plugins.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"plugin", "method", "code"})
+
+	// GRPCStreams reports the open gRPC streams of the kubelet to the device plugins
+	GRPCStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "grpc_streams",
+		Help:      "The open gRPC streams (ListAndWatch) of the kubelet to the device plugins.",
+	}, []string{"plugin", "method"})
+
+	// GRPCStreamsClosed counts the gRPC streams of the kubelet to the device plugins which ended
+	GRPCStreamsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "grpc_streams_closed_total",
+		Help:      "The number of gRPC streams (ListAndWatch) of the kubelet to the device plugins which ended.",
+	}, []string{"plugin", "method", "code"})
+
+	// GRPCPanics counts the panics which were recovered in gRPC calls
+	GRPCPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "grpc_panics_total",
+		Help:      "The number of panics which were recovered in gRPC calls of the kubelet to the device plugins.",
+	}, []string{"plugin", "method"})
+
+	// SocketRecoveries counts how often the device plugins recreated their sockets
+	SocketRecoveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "socket_recoveries_total",
+		Help:      "The number of times that the device plugins recreated their socket after it was removed or their gRPC server failed.",
+	}, []string{"plugin"})
+
+	// ResourceEnabled reports if the device plugin for a configured resource is enabled or not
+	ResourceEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "resource_enabled",
+		Help:      "Whether the device plugin for a configured resource is enabled (1) or not (0).",
+	}, []string{"plugin", "kind", "resource_name", "mode"})
+
+	// NodeInfo reports the detected properties of the node which decide which TPM devices can be exposed
+	NodeInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "node_info",
+		Help:      "The detected kernel release, TPM family and resource manager availability of the node. The value is always 1.",
+	}, []string{"kernel_release", "tpm_family", "resource_manager"})
+
+	// PCRChanges counts how often the value of a PCR changed between PCR snapshots
+	// NOTE: the values are not labels as every change would create a new series, they are served at /pcrs instead
+	PCRChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "pcr_changes_total",
+		Help:      "The number of times the value of a PCR changed between two PCR snapshots.",
+	}, []string{"bank", "index"})
+
+	// PCRSnapshotTimestamp reports when the latest PCR snapshot was taken
+	PCRSnapshotTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "pcr_snapshot_timestamp_seconds",
+		Help:      "The time of the latest successful PCR snapshot in seconds since the epoch.",
+	})
+
+	// PCRSnapshotErrors counts the failed PCR snapshots
+	PCRSnapshotErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "pcr_snapshot_errors_total",
+		Help:      "The number of PCR snapshots which failed.",
+	})
+
+	// ProxyCommands counts the TPM commands which were forwarded by the proxy
+	ProxyCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "proxy_commands_total",
+		Help:      "The number of TPM commands which were forwarded to the device by the proxy.",
+	}, []string{"resource_name"})
+
+	// ProxyThrottledCommands counts the TPM commands which were delayed by the rate limit of their allocation
+	ProxyThrottledCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "proxy_throttled_commands_total",
+		Help:      "The number of TPM commands which were delayed by the rate limit of their allocation.",
+	}, []string{"resource_name"})
+
+	// ProxySessions reports the open proxy sessions
+	ProxySessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "proxy_sessions",
+		Help:      "The number of open proxy sessions of all allocations.",
+	}, []string{"resource_name"})
+
+	// ProxyRejectedSessions counts the proxy sessions which were rejected by the session limit of their allocation
+	ProxyRejectedSessions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "proxy_rejected_sessions_total",
+		Help:      "The number of proxy sessions which were rejected by the session limit of their allocation.",
+	}, []string{"resource_name"})
+
+	// CheckpointAllocations reports the allocations in the checkpoint
+	CheckpointAllocations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "checkpoint_allocations",
+		Help:      "The number of allocations in the checkpoint.",
+	}, []string{"resource_name"})
+
+	// OrphanedAllocations counts the allocations which were never assigned to a container
+	OrphanedAllocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "orphaned_allocations_total",
+		Help:      "The number of allocations which the kubelet never reported as assigned to a container.",
+	}, []string{"resource_name"})
+
+	// UntrackedAllocations reports the assigned devices which are missing from the checkpoint
+	UntrackedAllocations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "untracked_devices",
+		Help:      "The number of devices which the kubelet reports as assigned, but which are not in the checkpoint.",
+	}, []string{"resource_name"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		BuildInfo,
+		GRPCDuration,
+		GRPCStreams,
+		GRPCStreamsClosed,
+		GRPCPanics,
+		SocketRecoveries,
+		ResourceEnabled,
+		NodeInfo,
+		PCRChanges,
+		PCRSnapshotTimestamp,
+		PCRSnapshotErrors,
+		ProxyCommands,
+		ProxyThrottledCommands,
+		ProxySessions,
+		ProxyRejectedSessions,
+		CheckpointAllocations,
+		OrphanedAllocations,
+		UntrackedAllocations,
+	)
+}
+
+// Handler returns the HTTP handler which serves all metrics of the plugin
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
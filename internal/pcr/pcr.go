@@ -0,0 +1,173 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pcr takes snapshots of the PCR banks of a TPM 2.0, and publishes them periodically,
+// so that PCR values can be compared across the fleet.
+package pcr
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// NumPCRs is the number of PCRs of a PC Client TPM
+const NumPCRs = 24
+
+// pcrSelectSize is the size of the PCR selection bitmap for NumPCRs
+const pcrSelectSize = NumPCRs / 8
+
+// banks are the supported PCR banks by their name
+var banks = map[string]tpm2.TPMIAlgHash{
+	"sha1":    tpm2.TPMAlgSHA1,
+	"sha256":  tpm2.TPMAlgSHA256,
+	"sha384":  tpm2.TPMAlgSHA384,
+	"sha512":  tpm2.TPMAlgSHA512,
+	"sm3_256": tpm2.TPMAlgSM3256,
+}
+
+// Selection selects the PCRs to read
+type Selection struct {
+	// Banks are the names of the PCR banks, e.g. 'sha256'
+	Banks []string
+	// Indices are the PCR indices in every bank
+	Indices []uint
+}
+
+// Validate ensures that all banks are supported and that all indices exist
+func (s *Selection) Validate() error {
+	if len(s.Banks) == 0 {
+		return fmt.Errorf("no PCR banks selected")
+	}
+	for _, b := range s.Banks {
+		if _, ok := banks[b]; !ok {
+			names := make([]string, 0, len(banks))
+			for name := range banks {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unsupported PCR bank '%s', must be one of: %s", b, strings.Join(names, ", "))
+		}
+	}
+	if len(s.Indices) == 0 {
+		return fmt.Errorf("no PCR indices selected")
+	}
+	for _, i := range s.Indices {
+		if i >= NumPCRs {
+			return fmt.Errorf("PCR index %d out of range, must be less than %d", i, NumPCRs)
+		}
+	}
+	return nil
+}
+
+// Snapshot are the PCR values of a TPM at a point in time
+type Snapshot struct {
+	Time time.Time `json:"time"`
+	// Banks are the hex encoded PCR values by bank name and PCR index
+	Banks map[string]map[uint]string `json:"banks"`
+}
+
+// Read takes a snapshot of the selected PCRs of the TPM 2.0 at the given device path
+func Read(devicePath string, sel *Selection) (*Snapshot, error) {
+	t, err := transport.OpenTPM(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening TPM %s: %w", devicePath, err)
+	}
+	defer t.Close() // nolint: errcheck
+
+	return snapshot(t, sel)
+}
+
+// snapshot takes a snapshot of the selected PCRs of an open TPM 2.0
+func snapshot(t transport.TPM, sel *Selection) (*Snapshot, error) {
+	ret := &Snapshot{
+		Time:  time.Now().UTC(),
+		Banks: make(map[string]map[uint]string, len(sel.Banks)),
+	}
+	for _, bank := range sel.Banks {
+		values, err := readBank(t, banks[bank], sel.Indices)
+		if err != nil {
+			return nil, fmt.Errorf("reading PCR bank %s: %w", bank, err)
+		}
+		ret.Banks[bank] = values
+	}
+	return ret, nil
+}
+
+// readBank reads the given PCRs of a bank. A TPM returns at most 8 PCRs per TPM2_PCR_Read, so this
+// reads the remaining PCRs until the TPM returned all of them.
+func readBank(t transport.TPM, alg tpm2.TPMIAlgHash, indices []uint) (map[uint]string, error) {
+	ret := make(map[uint]string, len(indices))
+	remaining := append([]uint{}, indices...)
+	for len(remaining) > 0 {
+		rsp, err := tpm2.PCRRead{
+			PCRSelectionIn: tpm2.TPMLPCRSelection{
+				PCRSelections: []tpm2.TPMSPCRSelection{
+					{
+						Hash:      alg,
+						PCRSelect: pcrSelect(remaining),
+					},
+				},
+			},
+		}.Execute(t)
+		if err != nil {
+			return nil, err
+		}
+
+		// the digests are in the order of the returned selection, PCRs which were not read are not part of it
+		var read []uint
+		for _, s := range rsp.PCRSelectionOut.PCRSelections {
+			if s.Hash != alg {
+				continue
+			}
+			for i := uint(0); i < uint(len(s.PCRSelect))*8; i++ {
+				if s.PCRSelect[i/8]&(1<<(i%8)) != 0 {
+					read = append(read, i)
+				}
+			}
+		}
+		if len(read) == 0 || len(read) != len(rsp.PCRValues.Digests) {
+			// the TPM does not have an allocated bank for this algorithm
+			return nil, fmt.Errorf("TPM returned %d PCR values for %d selected PCRs", len(rsp.PCRValues.Digests), len(read))
+		}
+		for i, index := range read {
+			ret[index] = hex.EncodeToString(rsp.PCRValues.Digests[i].Buffer)
+		}
+
+		next := remaining[:0]
+		for _, index := range remaining {
+			if _, ok := ret[index]; !ok {
+				next = append(next, index)
+			}
+		}
+		remaining = next
+	}
+	return ret, nil
+}
+
+// pcrSelect returns the PCR selection bitmap for the given PCRs
+func pcrSelect(indices []uint) []byte {
+	ret := make([]byte, pcrSelectSize)
+	for _, i := range indices {
+		ret[i/8] |= 1 << (i % 8)
+	}
+	return ret
+}
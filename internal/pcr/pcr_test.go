@@ -0,0 +1,43 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcr
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sel     Selection
+		wantErr bool
+	}{
+		{name: "valid", sel: Selection{Banks: []string{"sha1", "sha256"}, Indices: []uint{0, 7, 23}}},
+		{name: "no banks", sel: Selection{Indices: []uint{0}}, wantErr: true},
+		{name: "unsupported bank", sel: Selection{Banks: []string{"md5"}, Indices: []uint{0}}, wantErr: true},
+		{name: "no indices", sel: Selection{Banks: []string{"sha256"}}, wantErr: true},
+		{name: "index out of range", sel: Selection{Banks: []string{"sha256"}, Indices: []uint{NumPCRs}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sel.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/node"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AnnotationPCRs is the node annotation which holds the PCR values of the latest snapshot as JSON
+const AnnotationPCRs = "githedgehog.com/tpm-pcrs"
+
+// Publisher periodically takes PCR snapshots. It serves the latest snapshot over HTTP, reports it
+// as metrics, and optionally annotates the node with it.
+type Publisher struct {
+	l          *zap.Logger
+	devicePath string
+	sel        *Selection
+	interval   time.Duration
+	client     kubernetes.Interface
+	nodeName   string
+	// annotated is set once the node was annotated with the latest snapshot
+	annotated bool
+	mu        sync.RWMutex
+	latest    *Snapshot
+}
+
+// NewPublisher creates a publisher for the selected PCRs of the TPM 2.0 at the given device path.
+// If client is nil, the node is not being annotated.
+func NewPublisher(l *zap.Logger, devicePath string, sel *Selection, interval time.Duration, client kubernetes.Interface, nodeName string) (*Publisher, error) {
+	if err := sel.Validate(); err != nil {
+		return nil, err
+	}
+	return &Publisher{
+		l:          l.With(zap.String("device", devicePath)),
+		devicePath: devicePath,
+		sel:        sel,
+		interval:   interval,
+		client:     client,
+		nodeName:   nodeName,
+	}, nil
+}
+
+// Run takes a snapshot immediately, and then every interval until the context is cancelled
+func (p *Publisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.snapshot(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Publisher) snapshot(ctx context.Context) {
+	s, err := Read(p.devicePath, p.sel)
+	if err != nil {
+		p.l.Warn("Taking PCR snapshot failed", zap.Error(err))
+		metrics.PCRSnapshotErrors.Inc()
+		return
+	}
+
+	p.mu.Lock()
+	prev := p.latest
+	p.latest = s
+	p.mu.Unlock()
+
+	metrics.PCRSnapshotTimestamp.Set(float64(s.Time.Unix()))
+	changed := prev == nil || !reflect.DeepEqual(prev.Banks, s.Banks)
+	if changed {
+		p.l.Info("PCR values changed")
+		countChanges(prev, s)
+		p.annotated = false
+	}
+
+	// caller safeguard
+	if p.client == nil || p.annotated {
+		return
+	}
+	b, err := json.Marshal(s.Banks)
+	if err != nil {
+		p.l.Warn("Marshaling PCR values for the node annotation failed", zap.Error(err))
+		return
+	}
+	if err := node.Annotate(ctx, p.client, p.nodeName, map[string]string{AnnotationPCRs: string(b)}); err != nil {
+		// we try again with the next snapshot
+		p.l.Warn("Annotating node with PCR values failed", zap.Error(err))
+		return
+	}
+	p.annotated = true
+}
+
+// countChanges counts the PCRs whose values differ from the previous snapshot. The counters of all PCRs
+// are initialized with the first snapshot, so that they exist before the first change.
+func countChanges(prev, s *Snapshot) {
+	for bank, values := range s.Banks {
+		for index, value := range values {
+			c := metrics.PCRChanges.WithLabelValues(bank, strconv.FormatUint(uint64(index), 10))
+			if prev == nil {
+				c.Add(0)
+				continue
+			}
+			if prevValue, ok := prev.Banks[bank][index]; ok && prevValue != value {
+				c.Inc()
+			}
+		}
+	}
+}
+
+// ServeHTTP serves the latest snapshot as JSON
+func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.RLock()
+	s := p.latest
+	p.mu.RUnlock()
+	if s == nil {
+		http.Error(w, "no PCR snapshot available yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		p.l.Debug("Writing PCR snapshot response failed", zap.Error(err))
+	}
+}
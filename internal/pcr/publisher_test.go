@@ -0,0 +1,53 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcr
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+)
+
+func TestCountChanges(t *testing.T) {
+	metrics.PCRChanges.Reset()
+	t.Cleanup(metrics.PCRChanges.Reset)
+
+	first := &Snapshot{Banks: map[string]map[uint]string{"sha256": {0: "00", 1: "00"}}}
+	countChanges(nil, first)
+	if got := testutil.CollectAndCount(metrics.PCRChanges); got != 2 {
+		t.Fatalf("expected a counter for every PCR after the first snapshot, got %d", got)
+	}
+	if got := testutil.ToFloat64(metrics.PCRChanges.WithLabelValues("sha256", "0")); got != 0 {
+		t.Errorf("expected no changes after the first snapshot, got %v", got)
+	}
+
+	second := &Snapshot{Banks: map[string]map[uint]string{"sha256": {0: "00", 1: "01"}}}
+	countChanges(first, second)
+	countChanges(second, &Snapshot{Banks: map[string]map[uint]string{"sha256": {0: "00", 1: "02"}}})
+	if got := testutil.ToFloat64(metrics.PCRChanges.WithLabelValues("sha256", "0")); got != 0 {
+		t.Errorf("expected no changes of PCR 0, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.PCRChanges.WithLabelValues("sha256", "1")); got != 2 {
+		t.Errorf("expected 2 changes of PCR 1, got %v", got)
+	}
+	// the values are never exposed as labels
+	if got := testutil.CollectAndCount(metrics.PCRChanges); got != 2 {
+		t.Errorf("expected one series per PCR, got %d", got)
+	}
+}
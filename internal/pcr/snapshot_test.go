@@ -0,0 +1,135 @@
+//go:build cgo
+
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+// openSimulator opens the TPM simulator, which requires cgo
+func openSimulator(t *testing.T) transport.TPMCloser {
+	t.Helper()
+	sim, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatalf("opening TPM simulator: %v", err)
+	}
+	t.Cleanup(func() { sim.Close() }) // nolint: errcheck
+	return sim
+}
+
+func extend(t *testing.T, sim transport.TPM, index uint, data []byte) {
+	t.Helper()
+	digest := sha256.Sum256(data)
+	_, err := tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMHandle(index),
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{
+				{
+					HashAlg: tpm2.TPMAlgSHA256,
+					Digest:  digest[:],
+				},
+			},
+		},
+	}.Execute(sim)
+	if err != nil {
+		t.Fatalf("extending PCR %d: %v", index, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	sim := openSimulator(t)
+	extend(t, sim, 7, []byte("secure boot"))
+
+	// more than 8 PCRs, so that the TPM needs more than one TPM2_PCR_Read
+	indices := make([]uint, NumPCRs)
+	for i := range indices {
+		indices[i] = uint(i)
+	}
+	snap, err := snapshot(sim, &Selection{Banks: []string{"sha1", "sha256"}, Indices: indices})
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+	if snap.Time.IsZero() {
+		t.Error("snapshot has no time")
+	}
+
+	for bank, size := range map[string]int{"sha1": 20, "sha256": 32} {
+		values := snap.Banks[bank]
+		if len(values) != NumPCRs {
+			t.Fatalf("bank %s: expected %d PCR values, got %d", bank, NumPCRs, len(values))
+		}
+		for _, i := range indices {
+			if len(values[i]) != 2*size {
+				t.Errorf("bank %s: PCR %d: expected a %d bytes digest, got '%s'", bank, i, size, values[i])
+			}
+		}
+	}
+
+	// PCR 0 was never extended, PCR 7 was extended once from zero
+	zero := make([]byte, sha256.Size)
+	if got, want := snap.Banks["sha256"][0], hex.EncodeToString(zero); got != want {
+		t.Errorf("sha256 PCR 0: expected %s, got %s", want, got)
+	}
+	digest := sha256.Sum256([]byte("secure boot"))
+	expected := sha256.Sum256(append(zero, digest[:]...))
+	if got, want := snap.Banks["sha256"][7], hex.EncodeToString(expected[:]); got != want {
+		t.Errorf("sha256 PCR 7: expected %s, got %s", want, got)
+	}
+}
+
+func TestSnapshotSubset(t *testing.T) {
+	sim := openSimulator(t)
+
+	snap, err := snapshot(sim, &Selection{Banks: []string{"sha256"}, Indices: []uint{0, 9, 23}})
+	if err != nil {
+		t.Fatalf("taking snapshot: %v", err)
+	}
+	values := snap.Banks["sha256"]
+	if len(values) != 3 {
+		t.Fatalf("expected 3 PCR values, got %d: %v", len(values), values)
+	}
+	for _, i := range []uint{0, 9, 23} {
+		if _, ok := values[i]; !ok {
+			t.Errorf("PCR %d is missing", i)
+		}
+	}
+}
+
+func TestSnapshotUnallocatedBank(t *testing.T) {
+	sim := openSimulator(t)
+
+	// the simulator does not allocate an SM3 bank
+	_, err := snapshot(sim, &Selection{Banks: []string{"sm3_256"}, Indices: []uint{0}})
+	if err == nil {
+		t.Fatal("expected an error for an unallocated PCR bank")
+	}
+	if !strings.Contains(err.Error(), "sm3_256") {
+		t.Errorf("expected the bank in the error, got: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/pluginerr"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// validateDeviceIDs checks the device IDs of a container request against the devices which were advertised
+// to the kubelet. It rejects unknown and unhealthy devices, and returns the device IDs without duplicates
+// in the order of the request. An exclusive device can only be requested once per container.
+// NOTE: all devices of a plugin map to the same device node on the host, the backends only pass it once
+// no matter how many devices a container requested.
+func validateDeviceIDs(advertised []*pluginapi.Device, deviceIDs []string, exclusive bool) ([]string, error) {
+	if len(deviceIDs) == 0 {
+		return nil, pluginerr.New(pluginerr.ErrUnknownDevice, "no device IDs requested")
+	}
+	if exclusive && len(deviceIDs) > 1 {
+		return nil, pluginerr.New(pluginerr.ErrTooManyDevices, "%d device IDs requested, but the device is exclusive", len(deviceIDs))
+	}
+	health := make(map[string]string, len(advertised))
+	for _, d := range advertised {
+		health[d.ID] = d.Health
+	}
+	seen := make(map[string]struct{}, len(deviceIDs))
+	ret := make([]string, 0, len(deviceIDs))
+	for _, id := range deviceIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		h, ok := health[id]
+		if !ok {
+			return nil, pluginerr.New(pluginerr.ErrUnknownDevice, "device %s was never advertised", id)
+		}
+		if h != pluginapi.Healthy {
+			return nil, pluginerr.New(pluginerr.ErrDeviceUnhealthy, "device %s is %s", id, h)
+		}
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
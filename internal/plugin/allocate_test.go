@@ -0,0 +1,173 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/pluginerr"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestValidateDeviceIDs(t *testing.T) {
+	shared := []*pluginapi.Device{
+		{ID: "tpmrm0-1", Health: pluginapi.Healthy},
+		{ID: "tpmrm0-2", Health: pluginapi.Healthy},
+		{ID: "tpmrm0-3", Health: pluginapi.Unhealthy},
+	}
+	exclusive := []*pluginapi.Device{
+		{ID: "tpm0", Health: pluginapi.Healthy},
+	}
+
+	tests := []struct {
+		name       string
+		advertised []*pluginapi.Device
+		deviceIDs  []string
+		exclusive  bool
+		want       []string
+		wantErr    error
+	}{
+		{
+			name:       "single device",
+			advertised: shared,
+			deviceIDs:  []string{"tpmrm0-2"},
+			want:       []string{"tpmrm0-2"},
+		},
+		{
+			name:       "several devices in the order of the request",
+			advertised: shared,
+			deviceIDs:  []string{"tpmrm0-2", "tpmrm0-1"},
+			want:       []string{"tpmrm0-2", "tpmrm0-1"},
+		},
+		{
+			name:       "duplicates",
+			advertised: shared,
+			deviceIDs:  []string{"tpmrm0-1", "tpmrm0-2", "tpmrm0-1"},
+			want:       []string{"tpmrm0-1", "tpmrm0-2"},
+		},
+		{
+			name:       "unknown device",
+			advertised: shared,
+			deviceIDs:  []string{"tpmrm0-1", "tpmrm0-9"},
+			wantErr:    pluginerr.ErrUnknownDevice,
+		},
+		{
+			name:       "unhealthy device",
+			advertised: shared,
+			deviceIDs:  []string{"tpmrm0-3"},
+			wantErr:    pluginerr.ErrDeviceUnhealthy,
+		},
+		{
+			name:       "no devices advertised",
+			advertised: nil,
+			deviceIDs:  []string{"tpmrm0-1"},
+			wantErr:    pluginerr.ErrUnknownDevice,
+		},
+		{
+			name:       "empty request",
+			advertised: shared,
+			deviceIDs:  nil,
+			wantErr:    pluginerr.ErrUnknownDevice,
+		},
+		{
+			name:       "exclusive device",
+			advertised: exclusive,
+			deviceIDs:  []string{"tpm0"},
+			exclusive:  true,
+			want:       []string{"tpm0"},
+		},
+		{
+			name:       "exclusive device requested twice",
+			advertised: exclusive,
+			deviceIDs:  []string{"tpm0", "tpm0"},
+			exclusive:  true,
+			wantErr:    pluginerr.ErrTooManyDevices,
+		},
+		{
+			name:       "exclusive device with an unknown device",
+			advertised: exclusive,
+			deviceIDs:  []string{"tpm0", "tpm1"},
+			exclusive:  true,
+			wantErr:    pluginerr.ErrTooManyDevices,
+		},
+		{
+			name:       "unknown exclusive device",
+			advertised: exclusive,
+			deviceIDs:  []string{"tpm1"},
+			exclusive:  true,
+			wantErr:    pluginerr.ErrUnknownDevice,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateDeviceIDs(tt.advertised, tt.deviceIDs, tt.exclusive)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected device IDs %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAllocateEKMount(t *testing.T) {
+	for _, mountEK := range []bool{true, false} {
+		backend := &fakeBackend{devices: testDevices(pluginapi.Healthy, 1)}
+		pi, err := New(zap.NewNop(), Options{
+			Name:         "tpmrm",
+			ResourceName: "githedgehog.com/tpmrm",
+			SocketName:   "hh-tpmrm.sock",
+			MountEK:      mountEK,
+			Services: Services{
+				EKDir:           "/var/lib/k8s-tpm-device-plugin/ek",
+				EKContainerPath: "/etc/tpm/ek",
+			},
+		}, backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := pi.(*server)
+		p.devices.Publish(backend.Devices())
+
+		resp, err := p.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{backend.Devices()[0].ID}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mounts := resp.ContainerResponses[0].Mounts
+		if mountEK && (len(mounts) != 1 || mounts[0].ContainerPath != "/etc/tpm/ek" || !mounts[0].ReadOnly) {
+			t.Errorf("expected the read-only EK mount, got %v", mounts)
+		}
+		if !mountEK && len(mounts) != 0 {
+			t.Errorf("expected no EK mount, got %v", mounts)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// broadcaster fans out every change of the devices of a plugin to all subscribers. Every ListAndWatch
+// stream is a subscriber. Subscribers only ever receive the latest devices: if a subscriber did not
+// consume a previous change yet, it gets replaced by the newer one.
+type broadcaster struct {
+	mu          sync.Mutex
+	devices     []*pluginapi.Device
+	subscribers map[chan []*pluginapi.Device]struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		subscribers: make(map[chan []*pluginapi.Device]struct{}),
+	}
+}
+
+// Subscribe returns a channel which receives the current devices immediately if there are any, and every
+// change afterwards. The returned function must be called to unsubscribe again.
+func (b *broadcaster) Subscribe() (<-chan []*pluginapi.Device, func()) {
+	ch := make(chan []*pluginapi.Device, 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.devices != nil {
+		ch <- b.devices
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, ch)
+	}
+}
+
+// Publish sends the devices to all subscribers if they changed. It returns true if they did.
+func (b *broadcaster) Publish(devices []*pluginapi.Device) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.devices != nil && devicesEqual(b.devices, devices) {
+		return false
+	}
+	b.devices = devices
+	for ch := range b.subscribers {
+		// drop a change which was not consumed yet, it is outdated now
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- devices
+	}
+	return true
+}
+
+// Devices returns the devices which were published last
+func (b *broadcaster) Devices() []*pluginapi.Device {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.devices
+}
+
+// Subscribers returns the number of current subscribers
+func (b *broadcaster) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+func devicesEqual(a, b []*pluginapi.Device) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Health != b[i].Health || numaNode(a[i]) != numaNode(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// numaNode returns the NUMA node of a device, or -1 if it has no topology.
+// NOTE: the plugins advertise at most one NUMA node per device.
+func numaNode(d *pluginapi.Device) int64 {
+	if d.Topology == nil || len(d.Topology.Nodes) == 0 {
+		return -1
+	}
+	return d.Topology.Nodes[0].ID
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeStream is a ListAndWatch stream which records all devices that were sent to it
+type fakeStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	sentCh chan []*pluginapi.Device
+}
+
+func newFakeStream(ctx context.Context) *fakeStream {
+	return &fakeStream{
+		ctx:    ctx,
+		sentCh: make(chan []*pluginapi.Device, 16),
+	}
+}
+
+func (s *fakeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeStream) Send(resp *pluginapi.ListAndWatchResponse) error {
+	s.sentCh <- resp.Devices
+	return nil
+}
+
+// fakeBackend advertises the devices that it was given last
+type fakeBackend struct {
+	mu      sync.Mutex
+	devices []*pluginapi.Device
+}
+
+func (b *fakeBackend) Devices() []*pluginapi.Device {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.devices
+}
+
+func (b *fakeBackend) Allocate([]string) (*pluginapi.ContainerAllocateResponse, error) {
+	return &pluginapi.ContainerAllocateResponse{}, nil
+}
+
+func testDevices(health string, num int) []*pluginapi.Device {
+	devices := make([]*pluginapi.Device, 0, num)
+	for i := 0; i < num; i++ {
+		devices = append(devices, &pluginapi.Device{ID: fmt.Sprintf("tpmrm0-%d", i), Health: health})
+	}
+	return devices
+}
+
+func expectDevices(t *testing.T, s *fakeStream, want []*pluginapi.Device) {
+	t.Helper()
+	select {
+	case got := <-s.sentCh:
+		if !devicesEqual(got, want) {
+			t.Fatalf("expected devices %v, got %v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for devices %v", want)
+	}
+}
+
+func TestListAndWatchBroadcast(t *testing.T) {
+	backend := &fakeBackend{devices: testDevices(pluginapi.Healthy, 2)}
+	pi, err := New(zap.NewNop(), Options{
+		Name:         "tpmrm",
+		ResourceName: "githedgehog.com/tpmrm",
+		SocketName:   "hh-tpmrm.sock",
+	}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pi.(*server)
+	p.mu.Lock()
+	p.init()
+	p.mu.Unlock()
+
+	// open all streams at once
+	const numStreams = 8
+	type openStream struct {
+		stream *fakeStream
+		cancel context.CancelFunc
+		doneCh chan error
+	}
+	streams := make([]*openStream, 0, numStreams)
+	for i := 0; i < numStreams; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		s := &openStream{stream: newFakeStream(ctx), cancel: cancel, doneCh: make(chan error, 1)}
+		go func() {
+			s.doneCh <- p.ListAndWatch(&pluginapi.Empty{}, s.stream)
+		}()
+		streams = append(streams, s)
+	}
+	t.Cleanup(func() {
+		for _, s := range streams {
+			s.cancel()
+		}
+	})
+
+	// every stream gets the current devices first
+	for _, s := range streams {
+		expectDevices(t, s.stream, backend.Devices())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.devices.Subscribers() != numStreams && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := p.devices.Subscribers(); got != numStreams {
+		t.Fatalf("expected %d subscribers, got %d", numStreams, got)
+	}
+
+	// cancel every other stream, they must end and unsubscribe
+	live := make([]*openStream, 0, numStreams/2)
+	for i, s := range streams {
+		if i%2 == 0 {
+			live = append(live, s)
+			continue
+		}
+		s.cancel()
+		select {
+		case err := <-s.doneCh:
+			if err != nil {
+				t.Fatalf("stream %d ended with error: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stream %d did not end after it was cancelled", i)
+		}
+	}
+	if got := p.devices.Subscribers(); got != len(live) {
+		t.Fatalf("expected %d subscribers after cancelling streams, got %d", len(live), got)
+	}
+
+	// every live stream gets each update
+	updates := [][]*pluginapi.Device{
+		testDevices(pluginapi.Unhealthy, 2),
+		testDevices(pluginapi.Healthy, 2),
+		testDevices(pluginapi.Healthy, 4),
+	}
+	for _, devices := range updates {
+		backend.mu.Lock()
+		backend.devices = devices
+		backend.mu.Unlock()
+		p.Update()
+		for _, s := range live {
+			expectDevices(t, s.stream, devices)
+		}
+	}
+
+	// unchanged devices are not sent again
+	p.Update()
+	time.Sleep(100 * time.Millisecond)
+	for i, s := range live {
+		select {
+		case got := <-s.stream.sentCh:
+			t.Fatalf("stream %d got unchanged devices again: %v", i, got)
+		default:
+		}
+	}
+
+	// stopping the plugin ends all live streams
+	p.mu.Lock()
+	p.cleanup()
+	p.mu.Unlock()
+	for i, s := range live {
+		select {
+		case err := <-s.doneCh:
+			if err != nil {
+				t.Fatalf("stream %d ended with error: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stream %d did not end after the plugin stopped", i)
+		}
+	}
+}
+
+func TestBroadcasterKeepsLatestDevices(t *testing.T) {
+	b := newBroadcaster()
+	ch, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	if !b.Publish(testDevices(pluginapi.Healthy, 1)) {
+		t.Fatal("expected the first devices to be published")
+	}
+	if b.Publish(testDevices(pluginapi.Healthy, 1)) {
+		t.Fatal("expected unchanged devices not to be published")
+	}
+	// a subscriber which did not consume a change only gets the latest one
+	latest := testDevices(pluginapi.Unhealthy, 1)
+	if !b.Publish(latest) {
+		t.Fatal("expected changed devices to be published")
+	}
+	if got := <-ch; !devicesEqual(got, latest) {
+		t.Fatalf("expected devices %v, got %v", latest, got)
+	}
+	select {
+	case got := <-ch:
+		t.Fatalf("expected no further devices, got %v", got)
+	default:
+	}
+
+	// a new subscriber gets the current devices immediately
+	ch2, unsubscribe2 := b.Subscribe()
+	defer unsubscribe2()
+	if got := <-ch2; !devicesEqual(got, latest) {
+		t.Fatalf("expected devices %v, got %v", latest, got)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// DefaultCDISpecDir is the default directory where container runtimes look for CDI specs
+const DefaultCDISpecDir = "/var/run/cdi"
+
+// cdiVersion is the version of the CDI specification that we write, 0.5.0 introduced host paths for device nodes
+const cdiVersion = "0.5.0"
+
+// cdiSpec is the subset of a CDI spec which we need to pass device nodes into containers.
+// See https://github.com/cncf-tags/container-device-interface/blob/main/SPEC.md for details.
+type cdiSpec struct {
+	Version string       `json:"cdiVersion"`
+	Kind    string       `json:"kind"`
+	Devices []*cdiDevice `json:"devices"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	DeviceNodes []*cdiDeviceNode `json:"deviceNodes"`
+}
+
+type cdiDeviceNode struct {
+	Path        string       `json:"path"`
+	HostPath    string       `json:"hostPath"`
+	Type        string       `json:"type"`
+	Permissions string       `json:"permissions"`
+	UID         *uint32      `json:"uid,omitempty"`
+	GID         *uint32      `json:"gid,omitempty"`
+	FileMode    *os.FileMode `json:"fileMode,omitempty"`
+}
+
+// DeviceNodes passes device nodes of the host into containers. By default they are passed as device specs
+// which means that the container runtime creates them with the owner and mode of the device node on the host.
+// If CDI is enabled for a resource, they are passed as CDI devices instead. The CDI spec for the resource
+// sets the configured owner and mode which allows unprivileged containers to use the device.
+type DeviceNodes struct {
+	kind        string
+	permissions string
+	cdi         *config.CDI
+	fileMode    *os.FileMode
+	specPath    string
+	mu          sync.Mutex
+	spec        *cdiSpec
+}
+
+// NewDeviceNodes returns the device node settings of a resource. CDI specs are written to the given directory.
+func NewDeviceNodes(r *config.Resource, cdiSpecDir string) (*DeviceNodes, error) {
+	d := &DeviceNodes{
+		kind:        r.ResourceName,
+		permissions: r.Permissions,
+		cdi:         r.CDI,
+	}
+	if r.CDI != nil {
+		fileMode, err := r.CDI.ParseFileMode()
+		if err != nil {
+			return nil, fmt.Errorf("cdi: %w", err)
+		}
+		d.fileMode = fileMode
+		// the kind of a CDI spec is of the form 'vendor/class' just like a resource name
+		d.specPath = filepath.Join(cdiSpecDir, strings.ReplaceAll(r.ResourceName, "/", "-")+".json")
+		d.spec = &cdiSpec{
+			Version: cdiVersion,
+			Kind:    r.ResourceName,
+		}
+	}
+	return d, nil
+}
+
+// Add passes the device node at hostPath into the container at containerPath by adding it to the response
+func (d *DeviceNodes) Add(cresp *pluginapi.ContainerAllocateResponse, hostPath, containerPath string) error {
+	if d.cdi == nil {
+		cresp.Devices = append(cresp.Devices, &pluginapi.DeviceSpec{
+			ContainerPath: containerPath,
+			HostPath:      hostPath,
+			Permissions:   d.permissions,
+		})
+		return nil
+	}
+
+	name, err := d.cdiDevice(hostPath, containerPath)
+	if err != nil {
+		return err
+	}
+	cresp.CDIDevices = append(cresp.CDIDevices, &pluginapi.CDIDevice{
+		Name: d.kind + "=" + name,
+	})
+	return nil
+}
+
+// cdiDevice returns the name of the CDI device for the device node. It adds it to the CDI spec first if it is not part of it yet.
+func (d *DeviceNodes) cdiDevice(hostPath, containerPath string) (string, error) {
+	name := filepath.Base(hostPath)
+	if containerPath != hostPath {
+		name += "-as-" + filepath.Base(containerPath)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, dev := range d.spec.Devices {
+		if dev.Name == name {
+			return name, nil
+		}
+	}
+	d.spec.Devices = append(d.spec.Devices, &cdiDevice{
+		Name: name,
+		ContainerEdits: cdiContainerEdits{
+			DeviceNodes: []*cdiDeviceNode{
+				{
+					Path:        containerPath,
+					HostPath:    hostPath,
+					Type:        "c",
+					Permissions: d.permissions,
+					UID:         d.cdi.UID,
+					GID:         d.cdi.GID,
+					FileMode:    d.fileMode,
+				},
+			},
+		},
+	})
+	if err := d.writeSpec(); err != nil {
+		d.spec.Devices = d.spec.Devices[:len(d.spec.Devices)-1]
+		return "", err
+	}
+	return name, nil
+}
+
+// writeSpec atomically writes the CDI spec, so that a container runtime never reads a partial spec
+func (d *DeviceNodes) writeSpec() error {
+	b, err := json.Marshal(d.spec)
+	if err != nil {
+		return fmt.Errorf("cdi: marshaling spec: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(d.specPath), 0o755); err != nil {
+		return fmt.Errorf("cdi: creating spec directory: %w", err)
+	}
+	tmp := d.specPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil { // nolint: gosec
+		return fmt.Errorf("cdi: writing spec %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, d.specPath); err != nil {
+		return fmt.Errorf("cdi: renaming spec %s: %w", tmp, err)
+	}
+	return nil
+}
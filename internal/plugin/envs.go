@@ -0,0 +1,37 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import "strings"
+
+// DevicePathPlaceholder can be used in the values of configured environment variables,
+// it is replaced with the path of the device in the container
+const DevicePathPlaceholder = "$(TPM_DEVICE)"
+
+// RenderEnvs returns the environment variables for a container which was allocated the device at containerPath.
+// It replaces the device path placeholder in all values, and adds the TPM2TOOLS_TCTI variable if requested.
+// NOTE: the variables are used inside of the container, so they must always point to the container path.
+func RenderEnvs(envs map[string]string, containerPath string, tctiEnvVar bool) map[string]string {
+	ret := make(map[string]string, len(envs)+1)
+	for k, v := range envs {
+		ret[k] = strings.ReplaceAll(v, DevicePathPlaceholder, containerPath)
+	}
+	if tctiEnvVar {
+		ret["TPM2TOOLS_TCTI"] = "device:" + containerPath
+	}
+	return ret
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/events"
+
+	"go.uber.org/zap"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// CheckDevice checks if the device node at the given path exists and if it is a character device.
+// It returns an error describing the problem if it is not. It does not open the device as this
+// would interfere with the exclusive access to /dev/tpm0.
+func CheckDevice(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s is not a character device", path)
+	}
+	return nil
+}
+
+// DeviceHealth tracks the health of a device node. It logs and posts an event whenever the health changes.
+type DeviceHealth struct {
+	l       *zap.Logger
+	events  *events.Recorder
+	plugin  string
+	path    string
+	check   func(string) error
+	mu      sync.Mutex
+	healthy bool
+}
+
+// NewDeviceHealth returns a health tracker for the device node at the given path. The device is assumed
+// to be healthy initially, so that only an unhealthy device is being reported on the first check.
+func NewDeviceHealth(l *zap.Logger, eventRecorder *events.Recorder, plugin, path string) *DeviceHealth {
+	return NewHealth(l, eventRecorder, plugin, path, CheckDevice)
+}
+
+// NewHealth is like NewDeviceHealth, but checks the device at the given path with a custom check,
+// e.g. the socket or the address of a simulator
+func NewHealth(l *zap.Logger, eventRecorder *events.Recorder, plugin, path string, check func(string) error) *DeviceHealth {
+	return &DeviceHealth{
+		l:       l,
+		events:  eventRecorder,
+		plugin:  plugin,
+		path:    path,
+		check:   check,
+		healthy: true,
+	}
+}
+
+// Check checks the health of the device and returns it as it needs to be reported to the kubelet
+func (h *DeviceHealth) Check() string {
+	err := h.check(h.path)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		if h.healthy {
+			h.l.Warn("TPM device became unhealthy", zap.String("device", h.path), zap.Error(err))
+			h.events.DeviceUnhealthy(h.plugin, h.path, err)
+		}
+		h.healthy = false
+		return pluginapi.Unhealthy
+	}
+	if !h.healthy {
+		h.l.Info("TPM device became healthy", zap.String("device", h.path))
+		h.events.DeviceHealthy(h.plugin, h.path)
+	}
+	h.healthy = true
+	return pluginapi.Healthy
+}
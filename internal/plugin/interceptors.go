@@ -0,0 +1,106 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/pluginerr"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serverOptions returns the options of the gRPC server of a device plugin. Its interceptors recover panics
+// into an internal error, convert all errors into gRPC status errors, and log and measure every call.
+func serverOptions(l *zap.Logger, plugin, resourceName string) []grpc.ServerOption {
+	metadata := map[string]string{
+		"plugin":       plugin,
+		"resourceName": resourceName,
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryInterceptor(l, plugin, metadata)),
+		grpc.ChainStreamInterceptor(streamInterceptor(l, plugin, metadata)),
+	}
+}
+
+func unaryInterceptor(l *zap.Logger, plugin string, metadata map[string]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		start := time.Now()
+		defer func() {
+			if r := recover(); r != nil {
+				err = recovered(l, plugin, info.FullMethod, r)
+			}
+			err = pluginerr.Status(err, metadata)
+			observe(l, plugin, info.FullMethod, start, err)
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func streamInterceptor(l *zap.Logger, plugin string, metadata map[string]string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		start := time.Now()
+		metrics.GRPCStreams.WithLabelValues(plugin, info.FullMethod).Inc()
+		defer func() {
+			if r := recover(); r != nil {
+				err = recovered(l, plugin, info.FullMethod, r)
+			}
+			err = pluginerr.Status(err, metadata)
+			metrics.GRPCStreams.WithLabelValues(plugin, info.FullMethod).Dec()
+			observeStream(l, plugin, info.FullMethod, start, err)
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// recovered logs a recovered panic, and returns it as an internal error to the kubelet
+func recovered(l *zap.Logger, plugin, method string, r any) error {
+	l.Error("Recovered from panic in gRPC call", zap.String("method", method), zap.Any("panic", r), zap.Stack("stack"))
+	metrics.GRPCPanics.WithLabelValues(plugin, method).Inc()
+	return pluginerr.New(pluginerr.ErrBackend, "panic in %s: %v", method, r)
+}
+
+// observe logs a finished gRPC call, and records its duration
+func observe(l *zap.Logger, plugin, method string, start time.Time, err error) {
+	duration := time.Since(start)
+	code := status.Code(err)
+	metrics.GRPCDuration.WithLabelValues(plugin, method, code.String()).Observe(duration.Seconds())
+	logCall(l, "gRPC call", method, duration, code, err)
+}
+
+// observeStream logs a finished gRPC stream, and counts it. Streams are not part of the duration histogram,
+// as ListAndWatch streams only finish when the kubelet or the plugin go away.
+func observeStream(l *zap.Logger, plugin, method string, start time.Time, err error) {
+	duration := time.Since(start)
+	code := status.Code(err)
+	metrics.GRPCStreamsClosed.WithLabelValues(plugin, method, code.String()).Inc()
+	logCall(l, "gRPC stream", method, duration, code, err)
+}
+
+func logCall(l *zap.Logger, msg, method string, duration time.Duration, code codes.Code, err error) {
+	fields := []zap.Field{zap.String("method", method), zap.Duration("duration", duration), zap.Stringer("code", code)}
+	if err != nil {
+		l.Warn(msg+" failed", append(fields, zap.Error(err))...)
+		return
+	}
+	l.Debug(msg, fields...)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// histogramCount returns the number of observations of the gRPC duration histogram for a method
+func histogramCount(t *testing.T, plugin, method, code string) uint64 {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(metrics.GRPCDuration); err != nil {
+		t.Fatalf("registering histogram: %v", err)
+	}
+	defer reg.Unregister(metrics.GRPCDuration)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering histogram: %v", err)
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["plugin"] == plugin && labels["method"] == method && labels["code"] == code {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	const plugin = "test-stream"
+	const method = "/v1beta1.DevicePlugin/ListAndWatch"
+	interceptor := streamInterceptor(zap.NewNop(), plugin, nil)
+	info := &grpc.StreamServerInfo{FullMethod: method, IsServerStream: true}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- interceptor(nil, &fakeStream{ctx: context.Background()}, info, func(any, grpc.ServerStream) error {
+			close(started)
+			<-release
+			return status.Error(codes.Canceled, "kubelet went away")
+		})
+	}()
+
+	<-started
+	if got := testutil.ToFloat64(metrics.GRPCStreams.WithLabelValues(plugin, method)); got != 1 {
+		t.Errorf("expected 1 open stream, got %v", got)
+	}
+	close(release)
+	if err := <-done; status.Code(err) != codes.Canceled {
+		t.Errorf("expected the error of the stream, got %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.GRPCStreams.WithLabelValues(plugin, method)); got != 0 {
+		t.Errorf("expected no open streams, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.GRPCStreamsClosed.WithLabelValues(plugin, method, codes.Canceled.String())); got != 1 {
+		t.Errorf("expected 1 closed stream, got %v", got)
+	}
+	if got := histogramCount(t, plugin, method, codes.Canceled.String()); got != 0 {
+		t.Errorf("expected streams not to be in the duration histogram, got %d observations", got)
+	}
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	const plugin = "test-unary"
+	const method = "/v1beta1.DevicePlugin/Allocate"
+	interceptor := unaryInterceptor(zap.NewNop(), plugin, nil)
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+
+	if _, err := interceptor(context.Background(), nil, info, func(context.Context, any) (any, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := histogramCount(t, plugin, method, codes.OK.String()); got != 1 {
+		t.Errorf("expected 1 observation in the duration histogram, got %d", got)
+	}
+
+	// a panic is recovered into an internal error
+	_, err := interceptor(context.Background(), nil, info, func(context.Context, any) (any, error) {
+		panic("boom")
+	})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("expected an internal error for a panic, got %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.GRPCPanics.WithLabelValues(plugin, method)); got != 1 {
+		t.Errorf("expected 1 recovered panic, got %v", got)
+	}
+}
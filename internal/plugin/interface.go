@@ -16,10 +16,26 @@ limitations under the License.
 
 package plugin
 
-import "context"
+import (
+	"context"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
 
 type Interface interface {
 	Name() string
 	Start(context.Context) error
 	Stop(context.Context) error
+	// Update rediscovers the devices of the plugin, and sends them to the kubelet if they changed
+	Update()
+}
+
+// Backend is implemented by every kind of TPM device plugin. It provides the devices which are advertised
+// to the kubelet, and decides what a container gets access to when devices were allocated to it.
+// Everything else which is common to all device plugins is implemented by the server (see New).
+type Backend interface {
+	// Devices returns all devices which are advertised to the kubelet together with their current health
+	Devices() []*pluginapi.Device
+	// Allocate returns the response for a single container which was allocated the given device IDs
+	Allocate(deviceIDs []string) (*pluginapi.ContainerAllocateResponse, error)
 }
@@ -0,0 +1,154 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// LockFileName is the name of the lock file which guarantees that only one instance of the plugin
+	// serves its sockets on a node
+	LockFileName = "k8s-tpm-device-plugin.lock"
+	// DefaultLockDir is the default directory of the lock file, the default state directory of the plugin
+	// NOTE: this must not be the socket directory, as the kubelet removes all files in it when it starts
+	DefaultLockDir = "/var/lib/k8s-tpm-device-plugin/state"
+
+	lockFileMode = 0o600
+)
+
+var lockRetryInterval = time.Second * 5
+
+// InstanceLock is an advisory lock on the lock file in the lock directory. It is held by the active
+// instance of the plugin on a node, so that a second instance (e.g. an old pod which is stuck in terminating
+// during a rollout) does not remove and recreate the sockets of the active one.
+type InstanceLock struct {
+	l    *zap.Logger
+	path string
+	f    *os.File
+}
+
+// AcquireLock acquires the lock file in the given directory, which is created if it does not exist. If another
+// instance holds the lock, it retries until the lock is free or the timeout expired.
+func AcquireLock(ctx context.Context, l *zap.Logger, dir string, timeout time.Duration) (*InstanceLock, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil { // nolint: gosec
+		return nil, fmt.Errorf("creating lock directory %s: %w", dir, err)
+	}
+	k := &InstanceLock{
+		l:    l,
+		path: filepath.Join(dir, LockFileName),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		err := k.lock()
+		if err == nil {
+			l.Info("Acquired instance lock", zap.String("lockFile", k.path))
+			return k, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, err
+		}
+		l.Warn("Another instance of the plugin holds the instance lock, waiting for it to be released", zap.String("lockFile", k.path), zap.String("holder", k.holder()), zap.Duration("timeout", timeout))
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("another instance of the plugin (%s) holds the lock file %s: %w", k.holder(), k.path, err)
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// lock opens or creates the lock file, and locks it without blocking. It records this instance in the lock
+// file once it holds the lock, so that other instances can tell who holds it.
+func (k *InstanceLock) lock() error {
+	// NOTE: no O_TRUNC as this would clear the holder from the file of another instance
+	f, err := os.OpenFile(k.path, os.O_RDWR|os.O_CREATE, lockFileMode)
+	if err != nil {
+		return fmt.Errorf("opening lock file %s: %w", k.path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close() // nolint: errcheck
+		return fmt.Errorf("locking lock file %s: %w", k.path, err)
+	}
+	// the instance which held the lock before could have removed the file while we were waiting for it
+	if !k.isLockFile(f) {
+		f.Close() // nolint: errcheck
+		return fmt.Errorf("lock file %s was removed while locking it: %w", k.path, syscall.EWOULDBLOCK)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close() // nolint: errcheck
+		return fmt.Errorf("truncating lock file %s: %w", k.path, err)
+	}
+	hostname, _ := os.Hostname() // nolint: errcheck
+	if _, err := fmt.Fprintf(f, "pid=%d host=%s\n", os.Getpid(), hostname); err != nil {
+		f.Close() // nolint: errcheck
+		return fmt.Errorf("writing lock file %s: %w", k.path, err)
+	}
+	k.f = f
+	return nil
+}
+
+// holder returns who holds the lock as it was recorded in the lock file by the other instance
+func (k *InstanceLock) holder() string {
+	b, err := os.ReadFile(k.path)
+	if err != nil || len(b) == 0 {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// isLockFile returns if the file is the one which is at the path of the lock file
+func (k *InstanceLock) isLockFile(f *os.File) bool {
+	fi, err := os.Stat(k.path)
+	if err != nil {
+		return false
+	}
+	held, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, held)
+}
+
+// Release releases the lock, and removes the lock file
+func (k *InstanceLock) Release() error {
+	// caller safeguard
+	if k == nil || k.f == nil {
+		return nil
+	}
+	// remove the file before we unlock it, so that no other instance locks a file which is about to be removed
+	if k.isLockFile(k.f) {
+		if err := os.Remove(k.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing lock file %s: %w", k.path, err)
+		}
+	}
+	if err := k.f.Close(); err != nil {
+		return fmt.Errorf("closing lock file %s: %w", k.path, err)
+	}
+	k.f = nil
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestInstanceLock(t *testing.T) {
+	origInterval := lockRetryInterval
+	lockRetryInterval = 10 * time.Millisecond
+	t.Cleanup(func() { lockRetryInterval = origInterval })
+
+	dir := filepath.Join(t.TempDir(), "state")
+	first, err := AcquireLock(context.Background(), zap.NewNop(), dir, time.Second)
+	if err != nil {
+		t.Fatalf("acquiring lock: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, LockFileName))
+	if err != nil {
+		t.Fatalf("reading lock file: %v", err)
+	}
+	if want := fmt.Sprintf("pid=%d ", os.Getpid()); !strings.HasPrefix(string(b), want) {
+		t.Errorf("expected the lock file to record the holder %q, got %q", want, b)
+	}
+
+	// a second instance gives up after the timeout, and reports the holder
+	_, err = AcquireLock(context.Background(), zap.NewNop(), dir, 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected the second instance to fail while the lock is held")
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("pid=%d", os.Getpid())) {
+		t.Errorf("expected the holder in the error, got: %v", err)
+	}
+
+	// a waiting instance gets the lock once the first one released it
+	type result struct {
+		lock *InstanceLock
+		err  error
+	}
+	ch := make(chan result)
+	go func() {
+		k, err := AcquireLock(context.Background(), zap.NewNop(), dir, 5*time.Second)
+		ch <- result{lock: k, err: err}
+	}()
+	time.Sleep(5 * lockRetryInterval)
+	if err := first.Release(); err != nil {
+		t.Fatalf("releasing lock: %v", err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("acquiring released lock: %v", r.err)
+	}
+	if err := r.lock.Release(); err != nil {
+		t.Fatalf("releasing second lock: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, LockFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the lock file to be removed on release, got: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/pluginerr"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/podresources"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Policy enforces the policy of a resource on the pods which were allocated its devices.
+// NOTE: the kubelet only knows which pod the devices were allocated to after Allocate returned,
+// so the policy can only be enforced in PreStartContainer which fails the start of the container.
+type Policy struct {
+	resourceName    string
+	namespaces      map[string]struct{}
+	serviceAccounts map[string]struct{}
+	resolver        *podresources.Client
+	client          kubernetes.Interface
+}
+
+// NewPolicy returns the policy for the resource, or nil if the resource has no policy. The resolver finds
+// the pod that devices were allocated to, and the client is used to look up the service account of the pod.
+func NewPolicy(resourceName string, p *config.Policy, resolver *podresources.Client, client kubernetes.Interface) (*Policy, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if resolver == nil {
+		return nil, fmt.Errorf("policy: the pod resources API is required")
+	}
+	if len(p.ServiceAccounts) > 0 && client == nil {
+		return nil, fmt.Errorf("policy: a kubernetes client is required for service accounts")
+	}
+	ret := &Policy{
+		resourceName:    resourceName,
+		namespaces:      make(map[string]struct{}, len(p.Namespaces)),
+		serviceAccounts: make(map[string]struct{}, len(p.ServiceAccounts)),
+		resolver:        resolver,
+		client:          client,
+	}
+	for _, ns := range p.Namespaces {
+		ret.namespaces[ns] = struct{}{}
+	}
+	for _, sa := range p.ServiceAccounts {
+		ret.serviceAccounts[sa] = struct{}{}
+	}
+	return ret, nil
+}
+
+// Check returns an error if the pod which the devices were allocated to is not allowed to use them.
+// A nil Policy allows all pods.
+func (p *Policy) Check(ctx context.Context, deviceIDs []string) error {
+	// caller safeguard
+	if p == nil {
+		return nil
+	}
+	a, err := p.resolver.Find(ctx, p.resourceName, deviceIDs)
+	if err != nil {
+		return fmt.Errorf("policy: resolving pod of devices %v: %w", deviceIDs, err)
+	}
+	if a == nil {
+		return pluginerr.New(pluginerr.ErrPolicyDenied, "devices %v of %s are not assigned to any pod", deviceIDs, p.resourceName)
+	}
+	if _, ok := p.namespaces[a.Namespace]; ok {
+		return nil
+	}
+	if len(p.serviceAccounts) > 0 {
+		pod, err := p.client.CoreV1().Pods(a.Namespace).Get(ctx, a.Pod, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("policy: getting pod %s/%s: %w", a.Namespace, a.Pod, err)
+		}
+		sa := pod.Spec.ServiceAccountName
+		if sa == "" {
+			sa = "default"
+		}
+		if _, ok := p.serviceAccounts[a.Namespace+"/"+sa]; ok {
+			return nil
+		}
+		return pluginerr.New(pluginerr.ErrPolicyDenied, "pod %s/%s with service account %s is not allowed to use %s", a.Namespace, a.Pod, sa, p.resourceName)
+	}
+	return pluginerr.New(pluginerr.ErrPolicyDenied, "pod %s/%s is not allowed to use %s from namespace %s", a.Namespace, a.Pod, p.resourceName, a.Namespace)
+}
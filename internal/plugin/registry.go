@@ -0,0 +1,90 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// PluginsRegistryPath is the directory which the plugin watcher of the kubelet watches for plugin sockets
+const PluginsRegistryPath = "/var/lib/kubelet/plugins_registry"
+
+// RegistrationMode decides how the device plugins register with the kubelet
+type RegistrationMode string
+
+const (
+	// RegistrationModeKubelet serves the sockets in the kubelet device plugin directory, and registers
+	// every device plugin by calling the registration service on the kubelet socket
+	RegistrationModeKubelet RegistrationMode = "kubelet"
+	// RegistrationModePluginWatcher serves the sockets in the kubelet plugins registry directory. The plugin watcher
+	// of the kubelet discovers them, and registers the device plugins on its own, also after kubelet restarts.
+	RegistrationModePluginWatcher RegistrationMode = "plugin-watcher"
+)
+
+// ParseRegistrationMode parses a registration mode as it is being passed on the command-line
+func ParseRegistrationMode(s string) (RegistrationMode, error) {
+	switch m := RegistrationMode(s); m {
+	case RegistrationModeKubelet, RegistrationModePluginWatcher:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unsupported registration mode '%s', must be one of: %s, %s", s, RegistrationModeKubelet, RegistrationModePluginWatcher)
+	}
+}
+
+// socketDir returns the directory where the device plugin sockets are served in this registration mode
+func (m RegistrationMode) socketDir() string {
+	if m == RegistrationModePluginWatcher {
+		return PluginsRegistryPath
+	}
+	return pluginapi.DevicePluginPath
+}
+
+// registrationServer implements the plugin registration service for the plugin watcher of the kubelet
+type registrationServer struct {
+	p *server
+}
+
+var _ registerapi.RegistrationServer = &registrationServer{}
+
+// GetInfo implements v1.RegistrationServer
+func (r *registrationServer) GetInfo(context.Context, *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	r.p.l.Debug("GetInfo() call from the kubelet plugin watcher")
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DevicePlugin,
+		Name:              r.p.resourceName,
+		Endpoint:          r.p.socketPath,
+		SupportedVersions: []string{pluginapi.Version},
+	}, nil
+}
+
+// NotifyRegistrationStatus implements v1.RegistrationServer
+func (r *registrationServer) NotifyRegistrationStatus(_ context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	if !status.PluginRegistered {
+		r.p.l.Error("TPM Device Plugin registration with kubelet failed", zap.String("resourceName", r.p.resourceName), zap.String("error", status.Error))
+		r.p.events.RegistrationFailed(r.p.Name(), errors.New(status.Error))
+		return &registerapi.RegistrationStatusResponse{}, nil
+	}
+	r.p.l.Info("TPM Device Plugin registered with kubelet", zap.String("resourceName", r.p.resourceName))
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
@@ -0,0 +1,461 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/audit"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/checkpoint"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/events"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/pluginerr"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/podresources"
+
+	"k8s.io/client-go/kubernetes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// socketFileMode restricts the device plugin sockets to the kubelet which runs as root
+const socketFileMode = 0o600
+
+var (
+	connectionTimeout = time.Second * 5
+	registerTimeout   = time.Second * 30
+	healthInterval    = time.Second * 10
+)
+
+// Services are shared by all device plugins, every one of them is optional
+type Services struct {
+	// Audit records all allocations, can be nil
+	Audit *audit.Logger
+	// Checkpoint persists all allocations, can be nil
+	Checkpoint *checkpoint.Checkpoint
+	// Events posts Kubernetes events, can be nil
+	Events *events.Recorder
+	// CDISpecDir is the directory where the CDI specs for resources with CDI devices are written to
+	CDISpecDir string
+	// EKDir is the directory on the host with the cached endorsement keys, it is not mounted if empty or for simulators
+	EKDir string
+	// EKContainerPath is the path in containers where the EK directory is mounted read-only
+	EKContainerPath string
+	// ProxyDir is the directory on the host where the proxy sockets of resources in the proxy mode are created
+	ProxyDir string
+	// ProxySocketGID is the group which owns the proxy sockets
+	ProxySocketGID int
+	// PodResources resolves the pods that devices were allocated to for policies and the proxy
+	PodResources *podresources.Client
+	// Client is the Kubernetes client, can be nil if no policy needs it
+	Client kubernetes.Interface
+	// Registration decides how the device plugins register with the kubelet, defaults to the kubelet mode
+	Registration RegistrationMode
+}
+
+// Options are the settings of a device plugin server which are independent of its backend
+type Options struct {
+	// Name is the name of the device plugin instance which is used in logs
+	Name string
+	// ResourceName is the extended resource name which is registered with the kubelet
+	ResourceName string
+	// SocketName is the name of the unix socket in the kubelet device plugin directory
+	SocketName string
+	// Policy restricts which pods can use the devices, can be nil
+	Policy *config.Policy
+	// Exclusive is set if the device can only be used by a single container, which requests a single device ID
+	Exclusive bool
+	// MountEK is set if the devices are TPMs of the host, so that containers get the cached endorsement keys of the host
+	MountEK bool
+	Services
+}
+
+type server struct {
+	l            *zap.Logger
+	name         string
+	resourceName string
+	socketName   string
+	socketPath   string
+	registration RegistrationMode
+	exclusive    bool
+	backend      Backend
+	audit        *audit.Logger
+	checkpoint   *checkpoint.Checkpoint
+	events       *events.Recorder
+	ekMount      *pluginapi.Mount
+	policy       *Policy
+	devices      *broadcaster
+	// mu serializes starting and stopping the plugin with healing its socket
+	mu     sync.Mutex
+	server *grpc.Server
+	// stopMu guards stopCh which the ListAndWatch streams read while the plugin is being started or stopped
+	// NOTE: this is not mu, as stopping the gRPC server under mu waits for all streams to end
+	stopMu   sync.RWMutex
+	stopCh   chan struct{}
+	updateCh chan struct{}
+	healCh   chan struct{}
+}
+
+var _ Interface = &server{}
+var _ pluginapi.DevicePluginServer = &server{}
+
+// New creates a device plugin which serves the device plugin API for the given backend,
+// and registers it with the kubelet under the configured resource name.
+func New(l *zap.Logger, opts Options, backend Backend) (Interface, error) {
+	policy, err := NewPolicy(opts.ResourceName, opts.Policy, opts.PodResources, opts.Client)
+	if err != nil {
+		return nil, err
+	}
+	registration := opts.Registration
+	if registration == "" {
+		registration = RegistrationModeKubelet
+	}
+	var ekMount *pluginapi.Mount
+	if opts.MountEK && opts.EKDir != "" {
+		ekMount = &pluginapi.Mount{
+			ContainerPath: opts.EKContainerPath,
+			HostPath:      opts.EKDir,
+			ReadOnly:      true,
+		}
+	}
+	return &server{
+		l:            l,
+		name:         opts.Name,
+		resourceName: opts.ResourceName,
+		socketName:   opts.SocketName,
+		socketPath:   filepath.Join(registration.socketDir(), opts.SocketName),
+		registration: registration,
+		exclusive:    opts.Exclusive,
+		backend:      backend,
+		audit:        opts.Audit,
+		checkpoint:   opts.Checkpoint,
+		events:       opts.Events,
+		ekMount:      ekMount,
+		policy:       policy,
+		devices:      newBroadcaster(),
+		// buffered, so that an update is not lost while the devices are being discovered
+		updateCh: make(chan struct{}, 1),
+		healCh:   make(chan struct{}, 1),
+		// will be initialized by Start()
+		server: nil,
+		stopCh: nil,
+	}, nil
+}
+
+func (p *server) init() {
+	p.stopMu.Lock()
+	p.stopCh = make(chan struct{})
+	p.stopMu.Unlock()
+
+	// discover the devices once before we serve any stream, and keep watching them afterwards
+	p.devices.Publish(p.backend.Devices())
+	go p.watchDevices(p.stopCh)
+}
+
+func (p *server) cleanup() {
+	p.stopMu.Lock()
+	close(p.stopCh)
+	p.stopCh = nil
+	p.stopMu.Unlock()
+	p.server = nil
+}
+
+// stopChannel returns the channel which is closed when the plugin stops
+func (p *server) stopChannel() <-chan struct{} {
+	p.stopMu.RLock()
+	defer p.stopMu.RUnlock()
+	return p.stopCh
+}
+
+// Name implements Interface
+func (p *server) Name() string {
+	return p.name
+}
+
+// Start implements Interface
+func (p *server) Start(ctx context.Context) error {
+	// caller safeguard
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+
+	if err := p.Serve(ctx); err != nil {
+		p.stop() // nolint: errcheck
+		return err
+	}
+	p.l.Info("TPM Device Plugin server started")
+	go p.watchSocket(ctx, p.stopCh)
+	// the plugin watcher of the kubelet discovers the socket, and registers the plugin on its own
+	if p.registration == RegistrationModePluginWatcher {
+		p.l.Info("Waiting for the kubelet plugin watcher to register the TPM Device Plugin", zap.String("socket", p.socketPath))
+		return nil
+	}
+	if err := p.Register(ctx); err != nil {
+		p.events.RegistrationFailed(p.Name(), err)
+		p.stop() // nolint: errcheck
+		return err
+	}
+	p.l.Info("TPM Device Plugin registered with kubelet", zap.String("resourceName", p.resourceName))
+
+	return nil
+}
+
+// Stop implements Interface
+func (p *server) Stop(context.Context) error {
+	// caller safeguard
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stop()
+}
+
+// stop stops the gRPC server and all watchers, and removes the socket. It is a no-op if the plugin is not running.
+// NOTE: p.mu must be held
+func (p *server) stop() error {
+	if p.stopCh == nil {
+		return nil
+	}
+	// the gRPC server is not set yet if serving the socket failed early
+	if p.server != nil {
+		p.l.Info("Stopping gRPC server", zap.String("socket", p.socketPath))
+		p.server.Stop()
+	}
+	// the watchers must stop even if the socket cannot be removed
+	defer p.cleanup()
+	if err := os.Remove(p.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing socket path %s: %w", p.socketPath, err)
+	}
+	return nil
+}
+
+func (p *server) Serve(ctx context.Context) error {
+	// listen on unix socket
+	// NOTE: no need to close the listener as the gRPC methods close the listener automatically
+	// NOTE: removing the socket is safe as the instance lock guarantees that no other instance serves it
+	if err := os.Remove(p.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing socket path %s: %w", p.socketPath, err)
+	}
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "unix", p.socketPath)
+	if err != nil {
+		return fmt.Errorf("listening on unix socket %s: %w", p.socketPath, err)
+	}
+	if err := os.Chmod(p.socketPath, socketFileMode); err != nil {
+		l.Close() // nolint: errcheck
+		return fmt.Errorf("changing permissions of unix socket %s: %w", p.socketPath, err)
+	}
+
+	// a stopped gRPC server cannot serve again, so every listener gets a new one
+	p.server = grpc.NewServer(serverOptions(p.l, p.name, p.resourceName)...)
+	p.l.Info("Listening on unix socket for gRPC server now", zap.String("socket", p.socketPath))
+
+	// register the device plugin server API with the grpc server
+	pluginapi.RegisterDevicePluginServer(p.server, p)
+	if p.registration == RegistrationModePluginWatcher {
+		registerapi.RegisterRegistrationServer(p.server, &registrationServer{p: p})
+	}
+
+	// now run the gRPC server
+	// NOTE: the listener is broken if the server returns with an error, so we heal the socket instead of serving it again
+	go func(srv *grpc.Server) {
+		p.l.Info("Starting gRPC server now...")
+		// err is nil when Stop() or GracefulStop() were called
+		if err := srv.Serve(l); err != nil {
+			p.l.Error("gRPC server crashed", zap.Error(err))
+			p.heal()
+			return
+		}
+		p.l.Info("Stopped gRPC server")
+	}(p.server)
+
+	// connect to the gRPC server in blocking mode to ensure it is up before we return here
+	subCtx, cancel := context.WithTimeout(ctx, connectionTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(subCtx, "unix:"+p.socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return fmt.Errorf("gRPC server did not start within timeout %v: %w", connectionTimeout, err)
+	}
+	conn.Close() // nolint: errcheck
+
+	p.l.Info("Started gRPC server")
+	return nil
+}
+
+func (p *server) Register(ctx context.Context) error {
+	// connect to kubelet socket
+	connCtx, connCancel := context.WithTimeout(ctx, connectionTimeout)
+	defer connCancel()
+	conn, err := grpc.DialContext(connCtx, "unix:"+pluginapi.KubeletSocket, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return fmt.Errorf("connecting to kubelet socket at %s: %w", pluginapi.KubeletSocket, err)
+	}
+	defer conn.Close() // nolint: errcheck
+
+	client := pluginapi.NewRegistrationClient(conn)
+
+	regCtx, regCancel := context.WithTimeout(ctx, registerTimeout)
+	defer regCancel()
+	if _, err := client.Register(regCtx, &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     p.socketName,
+		ResourceName: p.resourceName,
+		Options:      p.options(),
+	}); err != nil {
+		return fmt.Errorf("gRPC register call: %w", err)
+	}
+
+	return nil
+}
+
+// Allocate implements v1beta1.DevicePluginServer
+func (p *server) Allocate(_ context.Context, allocateRequest *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	p.l.Debug("Allocate() call", zap.Reflect("allocateRequest", allocateRequest))
+	resp := &pluginapi.AllocateResponse{}
+	for _, req := range allocateRequest.ContainerRequests {
+		p.l.Debug("allocate ContainerRequest", zap.Reflect("creq", req))
+		deviceIDs, err := validateDeviceIDs(p.devices.Devices(), req.DevicesIDs, p.exclusive)
+		if err != nil {
+			return nil, err
+		}
+		cresp, err := p.backend.Allocate(deviceIDs)
+		if err != nil {
+			return nil, pluginerr.Wrap(pluginerr.ErrBackend, fmt.Errorf("allocating devices %v: %w", deviceIDs, err))
+		}
+		if p.ekMount != nil {
+			cresp.Mounts = append(cresp.Mounts, p.ekMount)
+		}
+		resp.ContainerResponses = append(resp.ContainerResponses, cresp)
+		p.checkpoint.Record(p.resourceName, deviceIDs, cresp)
+		p.audit.Record(&audit.Record{
+			Event:        audit.EventAllocate,
+			Plugin:       p.Name(),
+			ResourceName: p.resourceName,
+			DeviceIDs:    deviceIDs,
+			Devices:      cresp.Devices,
+			CDIDevices:   cresp.CDIDevices,
+			Envs:         cresp.Envs,
+			Mounts:       cresp.Mounts,
+		})
+	}
+	return resp, nil
+}
+
+// options returns the device plugin options which are being used during registration
+// NOTE: PreStartContainer calls are only required when they are being recorded in the audit log,
+// or when the policy is enforced
+func (p *server) options() *pluginapi.DevicePluginOptions {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                p.audit != nil || p.policy != nil,
+		GetPreferredAllocationAvailable: false,
+	}
+}
+
+// GetDevicePluginOptions implements v1beta1.DevicePluginServer
+func (p *server) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return p.options(), nil
+}
+
+// GetPreferredAllocation implements v1beta1.DevicePluginServer
+func (p *server) GetPreferredAllocation(_ context.Context, _ *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	p.l.Debug("GetPreferredAllocation() is unimplemented for this plugin")
+	return nil, pluginerr.New(pluginerr.ErrUnimplemented, "GetPreferredAllocation")
+}
+
+// Update implements Interface
+func (p *server) Update() {
+	// an update which is already pending is good enough
+	select {
+	case p.updateCh <- struct{}{}:
+	default:
+	}
+}
+
+// watchDevices rediscovers the devices periodically or immediately when we are asked to,
+// and broadcasts them to all ListAndWatch streams if they changed. It runs until stopCh is closed.
+func (p *server) watchDevices(stopCh <-chan struct{}) {
+	t := time.NewTicker(healthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-t.C:
+		case <-p.updateCh:
+			p.l.Debug("Rediscovering devices")
+		}
+		devices := p.backend.Devices()
+		if p.devices.Publish(devices) {
+			p.l.Info("Devices changed, sending update to kubelet", zap.Int("devices", len(devices)), zap.Int("streams", p.devices.Subscribers()))
+		}
+	}
+}
+
+// ListAndWatch implements v1beta1.DevicePluginServer
+// NOTE: the kubelet usually only opens one stream, but it can open a new one at any time (e.g. after it
+// restarted). Every stream receives all device changes until either the kubelet or the plugin ends it.
+func (p *server) ListAndWatch(_ *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	stopCh := p.stopChannel()
+	devicesCh, unsubscribe := p.devices.Subscribe()
+	defer unsubscribe()
+	p.l.Debug("ListAndWatch stream opened", zap.Int("streams", p.devices.Subscribers()))
+
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case <-s.Context().Done():
+			p.l.Debug("ListAndWatch stream closed by kubelet", zap.Error(s.Context().Err()))
+			return nil
+		case devices := <-devicesCh:
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+				return fmt.Errorf("sending devices: %w", err)
+			}
+		}
+	}
+}
+
+// PreStartContainer implements v1beta1.DevicePluginServer
+// NOTE: this is only being called by the kubelet if the audit log or the policy is enabled
+func (p *server) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	p.l.Debug("PreStartContainer() call", zap.Reflect("preStartContainerRequest", req))
+	if err := p.policy.Check(ctx, req.DevicesIDs); err != nil {
+		p.l.Warn("Refusing container start by policy", zap.Strings("deviceIDs", req.DevicesIDs), zap.Error(err))
+		p.events.PolicyViolation(p.Name(), err)
+		return nil, err
+	}
+	p.audit.Record(&audit.Record{
+		Event:        audit.EventPreStartContainer,
+		Plugin:       p.Name(),
+		ResourceName: p.resourceName,
+		DeviceIDs:    req.DevicesIDs,
+	})
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestStartFailedCleansUp(t *testing.T) {
+	backend := &fakeBackend{devices: testDevices(pluginapi.Healthy, 1)}
+	pi, err := New(zap.NewNop(), Options{
+		Name:         "tpmrm",
+		ResourceName: "githedgehog.com/tpmrm",
+		SocketName:   "hh-tpmrm.sock",
+	}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pi.(*server)
+	// the directory does not exist, so serving the socket fails
+	p.socketPath = filepath.Join(t.TempDir(), "missing", "hh-tpmrm.sock")
+
+	if err := p.Start(context.Background()); err == nil {
+		t.Fatal("Start() succeeded, want an error")
+	}
+	if p.stopChannel() != nil {
+		t.Error("stop channel is still set after Start() failed")
+	}
+	if p.server != nil {
+		t.Error("gRPC server is still set after Start() failed")
+	}
+	// the plugin is not running anymore, so stopping it is a no-op
+	if err := p.Stop(context.Background()); err != nil {
+		t.Errorf("Stop() = %v, want nil", err)
+	}
+	// starting the plugin again must not panic on a closed stop channel
+	if err := p.Start(context.Background()); err == nil {
+		t.Fatal("Start() succeeded, want an error")
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/plugin"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+var dialTimeout = time.Second * 2
+
+type simulatorBackend struct {
+	l       *zap.Logger
+	socket  string
+	address string
+	// containerPath is the path of the socket in containers
+	containerPath string
+	tcti          string
+	numDevices    uint
+	envs          map[string]string
+	health        *plugin.DeviceHealth
+}
+
+var _ plugin.Backend = &simulatorBackend{}
+
+// New creates a device plugin for the given resource which passes a TPM simulator to containers. Containers get
+// the directory of the unix socket of the simulator mounted, or only the TCP address, together with the matching TCTI.
+// It advertises the configured number of artificial devices, so that many containers can share the simulator.
+func New(l *zap.Logger, r *config.Resource, services plugin.Services) (plugin.Interface, error) {
+	if r.Kind != config.KindSimulator {
+		return nil, fmt.Errorf("unsupported kind '%s'", r.Kind)
+	}
+	// caller safeguard
+	if r.Simulator == nil {
+		return nil, fmt.Errorf("simulator not configured")
+	}
+	l = l.With(zap.String("plugin", r.Name))
+	containerPath := ContainerSocketPath(r.Simulator, r.ContainerPath)
+	return plugin.New(l, plugin.Options{
+		Name:         r.Name,
+		ResourceName: r.ResourceName,
+		SocketName:   r.SocketName,
+		Policy:       r.Policy,
+		Services:     services,
+	}, &simulatorBackend{
+		l:             l,
+		socket:        r.Simulator.Socket,
+		address:       r.Simulator.Address,
+		containerPath: containerPath,
+		tcti:          TCTI(r.Simulator, containerPath),
+		numDevices:    r.NumDevices,
+		envs:          r.Envs,
+		health:        plugin.NewHealth(l, services.Events, r.Name, Target(r.Simulator), newHealthCheck(r.Simulator)),
+	})
+}
+
+// ContainerSocketPath returns the path of the simulator socket in containers. The directory of the socket is
+// mounted at the directory of the configured container path, so the socket keeps its name from the host.
+func ContainerSocketPath(sim *config.Simulator, containerPath string) string {
+	if sim.Socket == "" {
+		return containerPath
+	}
+	return filepath.Join(filepath.Dir(containerPath), filepath.Base(sim.Socket))
+}
+
+// TCTI returns the TCTI configuration which containers use to reach the simulator,
+// e.g. 'swtpm:path=/var/run/tpm/tpm.sock' or 'mssim:host=10.0.0.1,port=2321'
+func TCTI(sim *config.Simulator, containerPath string) string {
+	if sim.Socket != "" {
+		return fmt.Sprintf("%s:path=%s", sim.Type, containerPath)
+	}
+	host, port, _ := net.SplitHostPort(sim.Address)
+	return fmt.Sprintf("%s:host=%s,port=%s", sim.Type, host, port)
+}
+
+// Target returns the socket or the address of the simulator for logs and events
+func Target(sim *config.Simulator) string {
+	if sim.Socket != "" {
+		return sim.Socket
+	}
+	return sim.Address
+}
+
+// Check checks if the simulator is available. It checks that the socket exists,
+// or it connects to the address and disconnects again right away.
+// NOTE: simulators serve only one client at a time, so connecting must not be used while pods use it.
+func Check(sim *config.Simulator) error {
+	if sim.Socket != "" {
+		fi, err := os.Stat(sim.Socket)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s is not a unix socket", sim.Socket)
+		}
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", sim.Address, dialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// newHealthCheck returns the periodic health check of the simulator. Sockets are checked on every call. Addresses
+// are only connected to until the simulator accepted a connection once, as a connection would block the session
+// of a pod, or fail while a pod uses the simulator.
+func newHealthCheck(sim *config.Simulator) func(string) error {
+	if sim.Socket != "" {
+		return func(string) error { return Check(sim) }
+	}
+	var mu sync.Mutex
+	reachable := false
+	return func(string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if reachable {
+			return nil
+		}
+		if err := Check(sim); err != nil {
+			return err
+		}
+		reachable = true
+		return nil
+	}
+}
+
+// Allocate implements plugin.Backend
+func (b *simulatorBackend) Allocate([]string) (*pluginapi.ContainerAllocateResponse, error) {
+	// the placeholder refers to the socket in the container, or to the address of the simulator
+	target := b.containerPath
+	if b.socket == "" {
+		target = b.address
+	}
+	cresp := &pluginapi.ContainerAllocateResponse{
+		Envs: plugin.RenderEnvs(b.envs, target, false),
+	}
+	cresp.Envs["TPM2TOOLS_TCTI"] = b.tcti
+	// NOTE: the directory is mounted instead of the socket, so that containers see the new socket when the
+	// simulator restarts and recreates it
+	if b.socket != "" {
+		cresp.Mounts = append(cresp.Mounts, &pluginapi.Mount{
+			ContainerPath: filepath.Dir(b.containerPath),
+			HostPath:      filepath.Dir(b.socket),
+		})
+	}
+	return cresp, nil
+}
+
+// Devices implements plugin.Backend
+func (b *simulatorBackend) Devices() []*pluginapi.Device {
+	health := b.health.Check()
+	ret := make([]*pluginapi.Device, 0, b.numDevices)
+	for i := uint(0); i < b.numDevices; i++ {
+		ret = append(ret, &pluginapi.Device{
+			ID:     fmt.Sprintf("simulator-%d", i),
+			Health: health,
+		})
+	}
+	return ret
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// accept counts and closes all connections until the listener is closed
+func accept(lis net.Listener, accepted *atomic.Int32) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		accepted.Add(1)
+		conn.Close() // nolint: errcheck
+	}
+}
+
+func TestHealthCheckAddress(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	var accepted atomic.Int32
+	go accept(lis, &accepted)
+	addr := lis.Addr().String()
+	lis.Close() // nolint: errcheck
+
+	check := newHealthCheck(&config.Simulator{Type: config.SimulatorTypeMSSIM, Address: addr})
+	if err := check(addr); err == nil {
+		t.Fatal("expected the check to fail while the simulator is not listening")
+	}
+
+	lis, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listening again: %v", err)
+	}
+	defer lis.Close() // nolint: errcheck
+	go accept(lis, &accepted)
+	for i := 0; i < 5; i++ {
+		if err := check(addr); err != nil {
+			t.Fatalf("check %d: %v", i, err)
+		}
+	}
+	// only the first successful check connects, the simulator only serves one client at a time
+	if n := accepted.Load(); n > 1 {
+		t.Errorf("expected at most 1 connection to the simulator, got %d", n)
+	}
+}
+
+func TestAllocateSocket(t *testing.T) {
+	r := &config.Resource{
+		Name:          "simulator",
+		Kind:          config.KindSimulator,
+		ResourceName:  "githedgehog.com/tpmrm",
+		SocketName:    "simulator.sock",
+		ContainerPath: config.SimulatorContainerPath,
+		NumDevices:    2,
+		Simulator:     &config.Simulator{Type: config.SimulatorTypeSWTPM, Socket: "/var/run/swtpm/swtpm.sock"},
+	}
+	containerPath := ContainerSocketPath(r.Simulator, r.ContainerPath)
+	if containerPath != "/var/run/tpm/swtpm.sock" {
+		t.Fatalf("expected the socket to keep its name in containers, got %s", containerPath)
+	}
+	b := &simulatorBackend{
+		l:             zap.NewNop(),
+		socket:        r.Simulator.Socket,
+		containerPath: containerPath,
+		tcti:          TCTI(r.Simulator, containerPath),
+	}
+	cresp, err := b.Allocate([]string{"simulator-0"})
+	if err != nil {
+		t.Fatalf("allocating: %v", err)
+	}
+	if len(cresp.Mounts) != 1 || cresp.Mounts[0].HostPath != "/var/run/swtpm" || cresp.Mounts[0].ContainerPath != "/var/run/tpm" {
+		t.Errorf("expected the socket directory to be mounted, got %v", cresp.Mounts)
+	}
+	if got := cresp.Envs["TPM2TOOLS_TCTI"]; got != "swtpm:path=/var/run/tpm/swtpm.sock" {
+		t.Errorf("expected the TCTI to point at the socket in the container, got %s", got)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+)
+
+var (
+	healBackoffInitial = time.Second
+	healBackoffMax     = time.Minute
+)
+
+// heal asks the socket watcher to recreate the socket of the plugin
+func (p *server) heal() {
+	// a heal which is already pending is good enough
+	select {
+	case p.healCh <- struct{}{}:
+	default:
+	}
+}
+
+// watchSocket watches the socket of the plugin until stopCh is closed. It recreates the socket and registers
+// the plugin again when the socket was removed, or when the gRPC server failed. Failed attempts are retried
+// with an exponential backoff.
+// NOTE: this is independent of watching the kubelet socket for kubelet restarts which restarts all plugins.
+func (p *server) watchSocket(ctx context.Context, stopCh <-chan struct{}) {
+	// NOTE: a nil channel blocks forever, so we still heal the socket when the gRPC server fails without the watcher
+	var fsEvents <-chan fsnotify.Event
+	var fsErrors <-chan error
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		p.l.Error("fsnotify: initializing socket watcher failed, the socket will not be recreated when it is removed", zap.Error(err))
+	} else {
+		defer fsw.Close()
+		// we need to watch the directory to get an event when the socket is removed
+		if err := fsw.Add(filepath.Dir(p.socketPath)); err != nil {
+			p.l.Error("fsnotify: watching socket directory failed, the socket will not be recreated when it is removed", zap.String("socket", p.socketPath), zap.Error(err))
+		} else {
+			fsEvents = fsw.Events
+			fsErrors = fsw.Errors
+		}
+	}
+	// the socket could have been removed before we started to watch it
+	if _, err := os.Stat(p.socketPath); err != nil {
+		p.heal()
+	}
+
+	backoff := healBackoffInitial
+	var retryCh <-chan time.Time
+	for {
+		var reason string
+		select {
+		case <-stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case event := <-fsEvents:
+			if event.Name != p.socketPath || event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			// the socket exists if it was recreated in the meantime, e.g. by healing it
+			if _, err := os.Stat(p.socketPath); err == nil {
+				continue
+			}
+			reason = "Socket of the device plugin was removed, recreating it..."
+		case err := <-fsErrors:
+			p.l.Warn("fsnotify socket watcher error", zap.Error(err))
+			continue
+		case <-p.healCh:
+			reason = "Socket of the device plugin is broken, recreating it..."
+		case <-retryCh:
+			reason = "Recreating socket of the device plugin again..."
+		}
+
+		if err := p.recoverSocket(ctx, stopCh, reason); err != nil {
+			p.l.Error("Recreating the socket of the device plugin failed, retrying...", zap.String("socket", p.socketPath), zap.Duration("backoff", backoff), zap.Error(err))
+			retryCh = time.After(backoff)
+			backoff *= 2
+			if backoff > healBackoffMax {
+				backoff = healBackoffMax
+			}
+			continue
+		}
+		backoff = healBackoffInitial
+		retryCh = nil
+	}
+}
+
+// recoverSocket stops the gRPC server, serves a new socket, and registers the plugin with the kubelet again
+func (p *server) recoverSocket(ctx context.Context, stopCh <-chan struct{}, reason string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// the plugin was stopped or restarted in the meantime, which recreated the socket already
+	if p.stopCh != stopCh {
+		return nil
+	}
+	p.l.Warn(reason, zap.String("socket", p.socketPath))
+	metrics.SocketRecoveries.WithLabelValues(p.name).Inc()
+
+	p.server.Stop()
+	if err := p.Serve(ctx); err != nil {
+		return err
+	}
+	if p.registration == RegistrationModePluginWatcher {
+		p.l.Info("Recreated socket, waiting for the kubelet plugin watcher to register the TPM Device Plugin", zap.String("socket", p.socketPath))
+		return nil
+	}
+	if err := p.Register(ctx); err != nil {
+		p.events.RegistrationFailed(p.Name(), err)
+		return err
+	}
+	p.l.Info("Recreated socket, TPM Device Plugin registered with kubelet again", zap.String("resourceName", p.resourceName))
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"sync"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/sysinfo"
+
+	"go.uber.org/zap"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// DeviceTopology discovers the NUMA node of a device node for the Topology Manager of the kubelet
+type DeviceTopology struct {
+	l    *zap.Logger
+	path string
+	mu   sync.Mutex
+	node int
+}
+
+// NewDeviceTopology returns the topology discovery for the device node at the given path
+func NewDeviceTopology(l *zap.Logger, path string) *DeviceTopology {
+	return &DeviceTopology{
+		l:    l,
+		path: path,
+		node: -1,
+	}
+}
+
+// Get discovers the NUMA node of the device, and returns the topology which is advertised with all of its
+// devices. It returns nil if the device has no NUMA affinity, which the Topology Manager treats as a device
+// that can be used from every NUMA node.
+func (t *DeviceTopology) Get() *pluginapi.TopologyInfo {
+	node, err := sysinfo.NUMANode(t.path)
+	if err != nil {
+		// the device is unhealthy in this case, which the health check reports already
+		t.l.Debug("Discovering NUMA node of device failed", zap.String("device", t.path), zap.Error(err))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if node != t.node {
+		t.l.Info("NUMA node of device changed", zap.String("device", t.path), zap.Int("numaNode", node))
+		t.node = node
+	}
+	if node < 0 {
+		return nil
+	}
+	return &pluginapi.TopologyInfo{
+		Nodes: []*pluginapi.NUMANode{{ID: int64(node)}},
+	}
+}
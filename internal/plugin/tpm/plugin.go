@@ -17,239 +17,115 @@ limitations under the License.
 package tpm
 
 import (
-	"context"
-	"errors"
 	"fmt"
-	"net"
-	"os"
 	"path/filepath"
-	"time"
+	"sync"
 
 	"go.uber.org/zap"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/events"
 	"go.githedgehog.com/k8s-tpm-device-plugin/internal/plugin"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/sysinfo"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-const (
-	tpmID         = "tpm0"
-	tpmSocketName = "hh-tpm.sock"
-)
-
-var (
-	connectionTimeout = time.Second * 5
-	registerTimeout   = time.Second * 30
-	errUnimplmented   = errors.New("plugin does not implement this method")
-)
-
-func UnimplementedError(str string) error {
-	return fmt.Errorf("%w: %s", errUnimplmented, str)
-}
-
-type tpmDevicePlugin struct {
-	l          *zap.Logger
-	tctiEnvVar bool
-	socketPath string
-	server     *grpc.Server
-	stopCh     chan struct{}
-}
-
-var _ plugin.Interface = &tpmDevicePlugin{}
-var _ pluginapi.DevicePluginServer = &tpmDevicePlugin{}
-
-func New(l *zap.Logger, tctiEnvVar bool) (plugin.Interface, error) {
-	return &tpmDevicePlugin{
-		l:          l.With(zap.String("plugin", "tpm")),
-		tctiEnvVar: tctiEnvVar,
-		socketPath: filepath.Join(pluginapi.DevicePluginPath, tpmSocketName),
-		// will be initialized by Start()
-		server: nil,
-		stopCh: nil,
-	}, nil
-}
-
-func (p *tpmDevicePlugin) init() {
-	p.server = grpc.NewServer()
-	p.stopCh = make(chan struct{})
+type tpmBackend struct {
+	l             *zap.Logger
+	name          string
+	id            string
+	devicePath    string
+	containerPath string
+	envs          map[string]string
+	tctiEnvVar    bool
+	events        *events.Recorder
+	nodes         *plugin.DeviceNodes
+	health        *plugin.DeviceHealth
+	topology      *plugin.DeviceTopology
+	skippedOnce   sync.Once
 }
 
-func (p *tpmDevicePlugin) cleanup() {
-	close(p.stopCh)
-	p.server = nil
-	p.stopCh = nil
-}
-
-func (p *tpmDevicePlugin) Name() string {
-	return "tpm"
-}
+var _ plugin.Backend = &tpmBackend{}
 
-// Start implements Interface
-func (p *tpmDevicePlugin) Start(ctx context.Context) error {
-	// caller safeguard
-	if p == nil {
-		return nil
-	}
-	p.init()
-
-	if err := p.Serve(ctx); err != nil {
-		return err
-	}
-	p.l.Info("TPM Device Plugin server started")
-	if err := p.Register(ctx); err != nil {
-		return err
+// New creates a device plugin for the given resource which passes through a TPM device, usually /dev/tpm0.
+// It advertises exactly one device as only one process can open the device at a time.
+// It is being used for both the tpm and the tpm12 kind as they only differ in which TPMs they support.
+func New(l *zap.Logger, r *config.Resource, services plugin.Services) (plugin.Interface, error) {
+	if r.Kind != config.KindTPM && r.Kind != config.KindTPM12 {
+		return nil, fmt.Errorf("unsupported kind '%s'", r.Kind)
 	}
-	p.l.Info("TPM Device Plugin registered with kubelet")
-
-	return nil
-}
-
-// Stop implements Interface
-func (p *tpmDevicePlugin) Stop(context.Context) error {
-	// caller safeguard
-	if p == nil || p.server == nil {
-		return nil
-	}
-	p.l.Info("Stopping gRPC server", zap.String("socket", p.socketPath))
-	p.server.Stop()
-	if err := os.Remove(p.socketPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("removing socket path %s: %w", p.socketPath, err)
+	nodes, err := plugin.NewDeviceNodes(r, services.CDISpecDir)
+	if err != nil {
+		return nil, err
 	}
-	p.cleanup()
-	return nil
+	l = l.With(zap.String("plugin", r.Name))
+	return plugin.New(l, plugin.Options{
+		Name:         r.Name,
+		ResourceName: r.ResourceName,
+		SocketName:   r.SocketName,
+		Policy:       r.Policy,
+		Exclusive:    true,
+		MountEK:      true,
+		Services:     services,
+	}, &tpmBackend{
+		l:             l,
+		name:          r.Name,
+		id:            filepath.Base(r.DevicePath),
+		devicePath:    r.DevicePath,
+		containerPath: r.ContainerPath,
+		envs:          r.Envs,
+		tctiEnvVar:    r.PassTPM2ToolsTCTIEnvVar,
+		events:        services.Events,
+		nodes:         nodes,
+		health:        plugin.NewDeviceHealth(l, services.Events, r.Name, r.DevicePath),
+		topology:      plugin.NewDeviceTopology(l, r.DevicePath),
+	})
 }
 
-func (p *tpmDevicePlugin) Serve(ctx context.Context) error {
-	// listen on unix socket
-	// NOTE: no need to close the listener as the gRPC methods close the listener automatically
-	if err := os.Remove(p.socketPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("removing socket path %s: %w", p.socketPath, err)
+// Allocate implements plugin.Backend
+func (b *tpmBackend) Allocate([]string) (*pluginapi.ContainerAllocateResponse, error) {
+	b.checkConflict()
+	cresp := &pluginapi.ContainerAllocateResponse{
+		Envs: plugin.RenderEnvs(b.envs, b.containerPath, b.tctiEnvVar),
 	}
-	var lc net.ListenConfig
-	l, err := lc.Listen(ctx, "unix", p.socketPath)
-	if err != nil {
-		return fmt.Errorf("listening on unix socket %s: %w", p.socketPath, err)
-	}
-	p.l.Info("Listening on unix socket for gRPC server now", zap.String("socket", p.socketPath))
-
-	// register the device plugin server API with the grpc server
-	pluginapi.RegisterDevicePluginServer(p.server, p)
-
-	// now run the gRPC server
-	go func() {
-		for {
-			p.l.Info("Starting gRPC server now...")
-			err := p.server.Serve(l)
-			// err is nil when Stop() or GracefulStop() were called
-			if err == nil {
-				p.l.Info("Stopped gRPC server")
-				return
-			}
-			p.l.Error("gRPC server crashed", zap.Error(err))
-		}
-	}()
-
-	// connect to the gRPC server in blocking mode to ensure it is up before we return here
-	subCtx, cancel := context.WithTimeout(ctx, connectionTimeout)
-	defer cancel()
-	conn, err := grpc.DialContext(subCtx, "unix:"+p.socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
-	if err != nil {
-		return fmt.Errorf("gRPC server did not start within timeout %v: %w", connectionTimeout, err)
+	if err := b.nodes.Add(cresp, b.devicePath, b.containerPath); err != nil {
+		return nil, err
 	}
-	conn.Close() // nolint: errcheck
-
-	p.l.Info("Started gRPC server")
-	return nil
+	return cresp, nil
 }
 
-func (p *tpmDevicePlugin) Register(ctx context.Context) error {
-	// connect to kubelet socket
-	connCtx, connCancel := context.WithTimeout(ctx, connectionTimeout)
-	defer connCancel()
-	conn, err := grpc.DialContext(connCtx, "unix:"+pluginapi.KubeletSocket, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+// checkConflict checks if the TPM device is already in use by another process on the host. The kubelet
+// will only allocate the device if no other pod holds it, so this means that it is held by the host itself
+// (e.g. by the tpm2-abrmd), and the pod will fail to open it. We log and post an event for this, but we do
+// not fail the allocation.
+// NOTE: this scans the file descriptors of all processes instead of opening the device, as opening it would take
+// the exclusive device away from its actual user for a moment. This requires the host PID namespace and the
+// CAP_SYS_PTRACE capability to see all processes on the host.
+func (b *tpmBackend) checkConflict() {
+	holders, skipped, err := sysinfo.DeviceHolders(b.devicePath)
 	if err != nil {
-		return fmt.Errorf("connecting to kubelet socket at %s: %w", pluginapi.KubeletSocket, err)
+		b.l.Warn("Conflict detection for TPM device failed", zap.String("device", b.devicePath), zap.Error(err))
+		return
 	}
-
-	client := pluginapi.NewRegistrationClient(conn)
-
-	regCtx, regCancel := context.WithTimeout(ctx, registerTimeout)
-	defer regCancel()
-	if _, err := client.Register(regCtx, &pluginapi.RegisterRequest{
-		Version:      pluginapi.Version,
-		Endpoint:     tpmSocketName,
-		ResourceName: "githedgehog.com/tpm",
-		Options: &pluginapi.DevicePluginOptions{
-			PreStartRequired:                false,
-			GetPreferredAllocationAvailable: false,
-		},
-	}); err != nil {
-		return fmt.Errorf("gRPC register call: %w", err)
+	if skipped > 0 {
+		b.skippedOnce.Do(func() {
+			b.l.Warn("Conflict detection for TPM device is not allowed to inspect all processes, it requires the CAP_SYS_PTRACE capability", zap.String("device", b.devicePath), zap.Int("skippedProcesses", skipped))
+		})
 	}
-
-	return nil
-}
-
-// Allocate implements v1beta1.DevicePluginServer
-func (p *tpmDevicePlugin) Allocate(_ context.Context, allocateRequest *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	p.l.Debug("Allocate() call", zap.Reflect("allocateRequest", allocateRequest))
-	resp := &pluginapi.AllocateResponse{}
-	for _, req := range allocateRequest.ContainerRequests {
-		p.l.Debug("allocate ContainerRequest", zap.Reflect("creq", req))
-		var envs map[string]string
-		if p.tctiEnvVar {
-			envs = map[string]string{
-				"TPM2TOOLS_TCTI": "device:/dev/tpm0",
-			}
-		}
-		cresp := &pluginapi.ContainerAllocateResponse{
-			Envs: envs,
-			Devices: []*pluginapi.DeviceSpec{
-				{
-					ContainerPath: "/dev/tpm0",
-					HostPath:      "/dev/tpm0",
-					Permissions:   "rwm",
-				},
-			},
-		}
-		resp.ContainerResponses = append(resp.ContainerResponses, cresp)
+	if len(holders) > 0 {
+		b.l.Warn("TPM device is already in use by another process on the host", zap.String("device", b.devicePath), zap.Ints("pids", holders))
+		b.events.ExclusiveConflict(b.name, b.devicePath)
 	}
-	return resp, nil
-}
-
-// GetDevicePluginOptions implements v1beta1.DevicePluginServer
-func (*tpmDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{
-		PreStartRequired:                false,
-		GetPreferredAllocationAvailable: false,
-	}, nil
-}
-
-// GetPreferredAllocation implements v1beta1.DevicePluginServer
-func (p *tpmDevicePlugin) GetPreferredAllocation(_ context.Context, _ *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	p.l.Debug("GetPreferredAllocation() is unimplemented for this plugin")
-	return nil, UnimplementedError("GetPreferredAllocation")
 }
 
-// ListAndWatch implements v1beta1.DevicePluginServer
-func (p *tpmDevicePlugin) ListAndWatch(_ *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: []*pluginapi.Device{
+// Devices implements plugin.Backend
+func (b *tpmBackend) Devices() []*pluginapi.Device {
+	return []*pluginapi.Device{
 		{
-			ID:     tpmID,
-			Health: pluginapi.Healthy,
+			ID:       b.id,
+			Health:   b.health.Check(),
+			Topology: b.topology.Get(),
 		},
-	}})
-
-	// TODO: there is nothing we are doing at the moment to check if the TPM is healthy or not
-	<-p.stopCh
-
-	return nil
-}
-
-// PreStartContainer implements v1beta1.DevicePluginServer
-func (p *tpmDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	p.l.Debug("PreStartContainer() is unimplemented for this plugin")
-	return &pluginapi.PreStartContainerResponse{}, nil
+	}
 }
@@ -18,247 +18,140 @@ package tpmrm
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"net"
-	"os"
 	"path/filepath"
-	"time"
 
 	"go.uber.org/zap"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
 	"go.githedgehog.com/k8s-tpm-device-plugin/internal/plugin"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/proxy"
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/sysinfo"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-const (
-	tpmrmID         = "tpmrm0"
-	tpmrmSocketName = "hh-tpmrm.sock"
-)
-
-var (
-	connectionTimeout = time.Second * 5
-	registerTimeout   = time.Second * 30
-	errUnimplmented   = errors.New("plugin does not implement this method")
-)
-
-func UnimplementedError(str string) error {
-	return fmt.Errorf("%w: %s", errUnimplmented, str)
-}
-
-type tpmrmDevicePlugin struct {
-	l          *zap.Logger
-	numDevices uint
-	tctiEnvVar bool
-	socketPath string
-	server     *grpc.Server
-	stopCh     chan struct{}
-}
-
-var _ plugin.Interface = &tpmrmDevicePlugin{}
-var _ pluginapi.DevicePluginServer = &tpmrmDevicePlugin{}
-
-func New(l *zap.Logger, numDevices uint, tctiEnvVar bool) (plugin.Interface, error) {
-	return &tpmrmDevicePlugin{
-		l:          l.With(zap.String("plugin", "tpmrm")),
-		numDevices: numDevices,
-		tctiEnvVar: tctiEnvVar,
-		socketPath: filepath.Join(pluginapi.DevicePluginPath, tpmrmSocketName),
-		// will be initialized by Start()
-		server: nil,
-		stopCh: nil,
-	}, nil
-}
-
-func (p *tpmrmDevicePlugin) init() {
-	p.server = grpc.NewServer()
-	p.stopCh = make(chan struct{})
-}
-
-func (p *tpmrmDevicePlugin) cleanup() {
-	close(p.stopCh)
-	p.server = nil
-	p.stopCh = nil
-}
-
-// Name implements Interface
-func (p *tpmrmDevicePlugin) Name() string {
-	return "tpmrm"
-}
-
-// Start implements Interface
-func (p *tpmrmDevicePlugin) Start(ctx context.Context) error {
-	// caller safeguard
-	if p == nil {
-		return nil
+type tpmrmBackend struct {
+	l             *zap.Logger
+	id            string
+	devicePath    string
+	containerPath string
+	numDevices    uint
+	envs          map[string]string
+	tctiEnvVar    bool
+	nodes         *plugin.DeviceNodes
+	health        *plugin.DeviceHealth
+	topology      *plugin.DeviceTopology
+	// proxy is set in the proxy mode, containers get a proxy socket instead of the device in this case
+	proxy *proxy.Manager
+	// unsupported is set if the TPM is not supported by the in-kernel resource manager,
+	// all devices will be advertised as unhealthy in this case
+	unsupported bool
+}
+
+var _ plugin.Backend = &tpmrmBackend{}
+
+// New creates a device plugin for the given resource which passes through a resource manager device, usually /dev/tpmrm0.
+// It advertises the configured number of artificial devices, so that many containers can share the device.
+// If the TPM of the device is a TPM 1.2 and the resource uses the unhealthy TPM 1.2 policy, all devices are unhealthy.
+// The proxies of released allocations in the proxy mode are removed until the context is cancelled.
+func New(ctx context.Context, l *zap.Logger, r *config.Resource, family sysinfo.TPMFamily, services plugin.Services) (plugin.Interface, error) {
+	if r.Kind != config.KindTPMRM {
+		return nil, fmt.Errorf("unsupported kind '%s'", r.Kind)
 	}
-	p.init()
-
-	if err := p.Serve(ctx); err != nil {
-		return err
+	nodes, err := plugin.NewDeviceNodes(r, services.CDISpecDir)
+	if err != nil {
+		return nil, err
 	}
-	p.l.Info("TPM Device Plugin server started")
-	if err := p.Register(ctx); err != nil {
-		return err
+	l = l.With(zap.String("plugin", r.Name))
+	unsupported := family == sysinfo.TPMFamily12 && r.TPM12Policy == config.TPM12PolicyUnhealthy
+	if unsupported {
+		l.Warn("TPM 1.2 is not supported by the in-kernel resource manager, advertising all devices as unhealthy")
 	}
-	p.l.Info("TPM Device Plugin registered with kubelet")
-
-	return nil
-}
-
-// Stop implements Interface
-func (p *tpmrmDevicePlugin) Stop(context.Context) error {
-	// caller safeguard
-	if p == nil || p.server == nil {
-		return nil
+	var proxyManager *proxy.Manager
+	if r.Proxy != nil {
+		proxyManager, err = proxy.NewManager(l, r.ResourceName, r.DevicePath, services.ProxyDir, services.ProxySocketGID, proxy.Limits{
+			CommandsPerSecond: r.Proxy.CommandsPerSecond,
+			Burst:             r.Proxy.Burst,
+			MaxSessions:       r.Proxy.MaxSessions,
+		}, services.PodResources)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		go proxyManager.Run(ctx)
 	}
-	p.l.Info("Stopping gRPC server", zap.String("socket", p.socketPath))
-	p.server.Stop()
-	if err := os.Remove(p.socketPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("removing socket path %s: %w", p.socketPath, err)
+	return plugin.New(l, plugin.Options{
+		Name:         r.Name,
+		ResourceName: r.ResourceName,
+		SocketName:   r.SocketName,
+		Policy:       r.Policy,
+		MountEK:      true,
+		Services:     services,
+	}, &tpmrmBackend{
+		l:             l,
+		id:            filepath.Base(r.DevicePath),
+		devicePath:    r.DevicePath,
+		containerPath: r.ContainerPath,
+		numDevices:    r.NumDevices,
+		envs:          r.Envs,
+		tctiEnvVar:    r.PassTPM2ToolsTCTIEnvVar,
+		nodes:         nodes,
+		health:        plugin.NewDeviceHealth(l, services.Events, r.Name, r.DevicePath),
+		topology:      plugin.NewDeviceTopology(l, r.DevicePath),
+		proxy:         proxyManager,
+		unsupported:   unsupported,
+	})
+}
+
+// Allocate implements plugin.Backend
+func (b *tpmrmBackend) Allocate(deviceIDs []string) (*pluginapi.ContainerAllocateResponse, error) {
+	if b.proxy != nil {
+		return b.allocateProxy(deviceIDs)
 	}
-	p.cleanup()
-	return nil
-}
-
-func (p *tpmrmDevicePlugin) Serve(ctx context.Context) error {
-	// listen on unix socket
-	// NOTE: no need to close the listener as the gRPC methods close the listener automatically
-	if err := os.Remove(p.socketPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("removing socket path %s: %w", p.socketPath, err)
+	cresp := &pluginapi.ContainerAllocateResponse{
+		Envs: plugin.RenderEnvs(b.envs, b.containerPath, b.tctiEnvVar),
 	}
-	var lc net.ListenConfig
-	l, err := lc.Listen(ctx, "unix", p.socketPath)
-	if err != nil {
-		return fmt.Errorf("listening on unix socket %s: %w", p.socketPath, err)
-	}
-	p.l.Info("Listening on unix socket for gRPC server now", zap.String("socket", p.socketPath))
-
-	// register the device plugin server API with the grpc server
-	pluginapi.RegisterDevicePluginServer(p.server, p)
-
-	// now run the gRPC server
-	go func() {
-		for {
-			p.l.Info("Starting gRPC server now...")
-			err := p.server.Serve(l)
-			// err is nil when Stop() or GracefulStop() were called
-			if err == nil {
-				p.l.Info("Stopped gRPC server")
-				return
-			}
-			p.l.Error("gRPC server crashed", zap.Error(err))
-		}
-	}()
-
-	// connect to the gRPC server in blocking mode to ensure it is up before we return here
-	subCtx, cancel := context.WithTimeout(ctx, connectionTimeout)
-	defer cancel()
-	conn, err := grpc.DialContext(subCtx, "unix:"+p.socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
-	if err != nil {
-		return fmt.Errorf("gRPC server did not start within timeout %v: %w", connectionTimeout, err)
+	if err := b.nodes.Add(cresp, b.devicePath, b.containerPath); err != nil {
+		return nil, err
 	}
-	conn.Close() // nolint: errcheck
-
-	p.l.Info("Started gRPC server")
-	return nil
+	return cresp, nil
 }
 
-func (p *tpmrmDevicePlugin) Register(ctx context.Context) error {
-	// connect to kubelet socket
-	connCtx, connCancel := context.WithTimeout(ctx, connectionTimeout)
-	defer connCancel()
-	conn, err := grpc.DialContext(connCtx, "unix:"+pluginapi.KubeletSocket, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+// allocateProxy mounts the directory with the proxy socket of the allocation into the container
+func (b *tpmrmBackend) allocateProxy(deviceIDs []string) (*pluginapi.ContainerAllocateResponse, error) {
+	dir, err := b.proxy.Allocate(deviceIDs)
 	if err != nil {
-		return fmt.Errorf("connecting to kubelet socket at %s: %w", pluginapi.KubeletSocket, err)
+		return nil, err
 	}
-
-	client := pluginapi.NewRegistrationClient(conn)
-
-	regCtx, regCancel := context.WithTimeout(ctx, registerTimeout)
-	defer regCancel()
-	if _, err := client.Register(regCtx, &pluginapi.RegisterRequest{
-		Version:      pluginapi.Version,
-		Endpoint:     tpmrmSocketName,
-		ResourceName: "githedgehog.com/tpmrm",
-		Options: &pluginapi.DevicePluginOptions{
-			PreStartRequired:                false,
-			GetPreferredAllocationAvailable: false,
-		},
-	}); err != nil {
-		return fmt.Errorf("gRPC register call: %w", err)
+	envs := plugin.RenderEnvs(b.envs, proxy.ContainerSocketPath, false)
+	if b.tctiEnvVar {
+		envs["TPM2TOOLS_TCTI"] = "swtpm:path=" + proxy.ContainerSocketPath
 	}
-
-	return nil
-}
-
-// Allocate implements v1beta1.DevicePluginServer
-func (p *tpmrmDevicePlugin) Allocate(_ context.Context, allocateRequest *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	p.l.Debug("Allocate() call", zap.Reflect("allocateRequest", allocateRequest))
-	resp := &pluginapi.AllocateResponse{}
-	for _, req := range allocateRequest.ContainerRequests {
-		p.l.Debug("allocate ContainerRequest", zap.Reflect("creq", req))
-		var envs map[string]string
-		if p.tctiEnvVar {
-			envs = map[string]string{
-				"TPM2TOOLS_TCTI": "device:/dev/tpmrm0",
-			}
-		}
-		cresp := &pluginapi.ContainerAllocateResponse{
-			Envs: envs,
-			Devices: []*pluginapi.DeviceSpec{
-				{
-					ContainerPath: "/dev/tpmrm0",
-					HostPath:      "/dev/tpmrm0",
-					Permissions:   "rwm",
-				},
-			},
-		}
-		resp.ContainerResponses = append(resp.ContainerResponses, cresp)
-	}
-	return resp, nil
-}
-
-// GetDevicePluginOptions implements v1beta1.DevicePluginServer
-func (*tpmrmDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{
-		PreStartRequired:                false,
-		GetPreferredAllocationAvailable: false,
+	return &pluginapi.ContainerAllocateResponse{
+		Envs: envs,
+		Mounts: []*pluginapi.Mount{{
+			ContainerPath: proxy.ContainerDir,
+			HostPath:      dir,
+		}},
 	}, nil
 }
 
-// GetPreferredAllocation implements v1beta1.DevicePluginServer
-func (p *tpmrmDevicePlugin) GetPreferredAllocation(_ context.Context, _ *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	p.l.Debug("GetPreferredAllocation() is unimplemented for this plugin")
-	return nil, UnimplementedError("GetPreferredAllocation")
-}
-
-// ListAndWatch implements v1beta1.DevicePluginServer
-func (p *tpmrmDevicePlugin) ListAndWatch(_ *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: generateDeviceIDs(p.numDevices)})
-
-	// TODO: there is nothing we are doing at the moment to check if the TPM is healthy or not
-	<-p.stopCh
-
-	return nil
+// Devices implements plugin.Backend
+func (b *tpmrmBackend) Devices() []*pluginapi.Device {
+	if b.unsupported {
+		return generateDeviceIDs(b.id, b.numDevices, pluginapi.Unhealthy, b.topology.Get())
+	}
+	return generateDeviceIDs(b.id, b.numDevices, b.health.Check(), b.topology.Get())
 }
 
-func generateDeviceIDs(num uint) []*pluginapi.Device {
+func generateDeviceIDs(id string, num uint, health string, topology *pluginapi.TopologyInfo) []*pluginapi.Device {
 	ret := make([]*pluginapi.Device, 0, num)
 	for i := uint(0); i < num; i++ {
 		ret = append(ret, &pluginapi.Device{
-			ID:     fmt.Sprintf("%s-%d", tpmrmID, i),
-			Health: pluginapi.Healthy,
+			ID:       fmt.Sprintf("%s-%d", id, i),
+			Health:   health,
+			Topology: topology,
 		})
 	}
 	return ret
 }
-
-// PreStartContainer implements v1beta1.DevicePluginServer
-func (p *tpmrmDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	p.l.Debug("PreStartContainer() is unimplemented for this plugin")
-	return &pluginapi.PreStartContainerResponse{}, nil
-}
@@ -0,0 +1,109 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pluginerr classifies the failures of the device plugins, and maps them to gRPC status codes with
+// structured details, so that the kubelet (and everyone reading its logs) can tell them apart.
+package pluginerr
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Domain is the domain of the error details of all errors of the plugin
+const Domain = "githedgehog.com"
+
+// The failure classes of the device plugins. Errors are classified by wrapping one of them, see New.
+var (
+	// ErrUnimplemented is returned for optional device plugin API methods which a plugin does not implement
+	ErrUnimplemented = errors.New("not implemented")
+	// ErrUnknownDevice is returned if the kubelet asks for a device ID which the plugin never advertised
+	ErrUnknownDevice = errors.New("unknown device ID")
+	// ErrPolicyDenied is returned if the policy of a resource does not allow the pod to use the devices
+	ErrPolicyDenied = errors.New("denied by policy")
+	// ErrDeviceUnhealthy is returned if the kubelet asks for a device which is unhealthy
+	ErrDeviceUnhealthy = errors.New("device is unhealthy")
+	// ErrTooManyDevices is returned if the kubelet asks for several devices of a resource with an exclusive device
+	ErrTooManyDevices = errors.New("too many devices")
+	// ErrBackend is returned if the backend of a plugin failed, e.g. writing a CDI spec or starting a proxy
+	ErrBackend = errors.New("backend failure")
+)
+
+type class struct {
+	err    error
+	code   codes.Code
+	reason string
+}
+
+// classes maps every failure class to its gRPC status code and the reason of its error details
+var classes = []class{
+	{err: ErrUnimplemented, code: codes.Unimplemented, reason: "UNIMPLEMENTED"},
+	{err: ErrUnknownDevice, code: codes.NotFound, reason: "UNKNOWN_DEVICE"},
+	{err: ErrPolicyDenied, code: codes.PermissionDenied, reason: "POLICY_DENIED"},
+	{err: ErrDeviceUnhealthy, code: codes.Unavailable, reason: "DEVICE_UNHEALTHY"},
+	{err: ErrTooManyDevices, code: codes.InvalidArgument, reason: "TOO_MANY_DEVICES"},
+	{err: ErrBackend, code: codes.Internal, reason: "BACKEND_FAILURE"},
+}
+
+// New returns an error of the given failure class with a formatted message
+func New(class error, format string, args ...any) error {
+	return fmt.Errorf("%w: %s", class, fmt.Sprintf(format, args...))
+}
+
+// Wrap classifies err as a failure of the given class, unless it is classified already
+func Wrap(class error, err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, c := range classes {
+		if errors.Is(err, c.err) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %w", class, err)
+}
+
+// Status converts an error into a gRPC status error with the code of its failure class. The status carries an
+// ErrorInfo with the reason and the given metadata, e.g. the plugin and the resource name. Unclassified errors
+// get the Unknown code, and errors which are a gRPC status already are returned unchanged.
+func Status(err error, metadata map[string]string) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code, reason := codes.Unknown, "UNKNOWN"
+	for _, c := range classes {
+		if errors.Is(err, c.err) {
+			code, reason = c.code, c.reason
+			break
+		}
+	}
+	st := status.New(code, err.Error())
+	if withDetails, detailsErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   Domain,
+		Metadata: metadata,
+	}); detailsErr == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
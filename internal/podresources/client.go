@@ -0,0 +1,114 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package podresources resolves which pods and containers the devices of a resource have been assigned to.
+// It uses the PodResources API of the kubelet for this purpose. Note that the kubelet only reports an assignment
+// after the Allocate call of a device plugin has returned successfully.
+package podresources
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// DefaultSocket is the default location of the kubelet PodResources API socket
+const DefaultSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+var (
+	connectionTimeout = time.Second * 5
+	listTimeout       = time.Second * 10
+)
+
+// Assignment describes a container to which devices of a resource have been assigned to
+type Assignment struct {
+	Namespace    string   `json:"namespace"`
+	Pod          string   `json:"pod"`
+	Container    string   `json:"container"`
+	ResourceName string   `json:"resourceName"`
+	DeviceIDs    []string `json:"deviceIDs"`
+}
+
+// Client queries the kubelet PodResources API
+type Client struct {
+	socket string
+}
+
+// New returns a new client for the kubelet PodResources API which is served on the given unix socket.
+// The client does not connect to the kubelet until it is being used.
+func New(socket string) *Client {
+	return &Client{socket: socket}
+}
+
+// List returns all device assignments of all containers as they are currently known to the kubelet
+func (c *Client) List(ctx context.Context) ([]*Assignment, error) {
+	connCtx, connCancel := context.WithTimeout(ctx, connectionTimeout)
+	defer connCancel()
+	conn, err := grpc.DialContext(connCtx, "unix:"+c.socket, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to kubelet pod resources socket at %s: %w", c.socket, err)
+	}
+	defer conn.Close() // nolint: errcheck
+
+	listCtx, listCancel := context.WithTimeout(ctx, listTimeout)
+	defer listCancel()
+	resp, err := podresourcesapi.NewPodResourcesListerClient(conn).List(listCtx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("gRPC list call: %w", err)
+	}
+
+	var ret []*Assignment
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, devices := range container.GetDevices() {
+				ret = append(ret, &Assignment{
+					Namespace:    pod.GetNamespace(),
+					Pod:          pod.GetName(),
+					Container:    container.GetName(),
+					ResourceName: devices.GetResourceName(),
+					DeviceIDs:    devices.GetDeviceIds(),
+				})
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Find returns the assignment of the container which holds any of the given devices of a resource.
+// It returns nil if none of the devices are assigned to a container (yet).
+func (c *Client) Find(ctx context.Context, resourceName string, deviceIDs []string) (*Assignment, error) {
+	assignments, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assignments {
+		if a.ResourceName != resourceName {
+			continue
+		}
+		for _, id := range a.DeviceIDs {
+			for _, want := range deviceIDs {
+				if id == want {
+					return a, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/podresources"
+
+	"go.uber.org/zap"
+)
+
+// DefaultDir is the default directory on the host where the proxy sockets of all allocations are created
+const DefaultDir = "/var/run/k8s-tpm-device-plugin/proxy"
+
+var (
+	gcInterval = time.Minute
+	// gcGracePeriod protects new allocations from the garbage collection, because
+	// the kubelet only reports an assignment after the Allocate call has returned
+	gcGracePeriod = time.Minute * 5
+)
+
+type allocation struct {
+	proxy     *allocationProxy
+	dir       string
+	deviceIDs []string
+	allocated time.Time
+}
+
+// Manager runs the proxies for all allocations of a resource. Every allocation gets its own directory
+// with a proxy socket, so that the limits apply to every allocation separately.
+type Manager struct {
+	l            *zap.Logger
+	resourceName string
+	devicePath   string
+	dir          string
+	socketGID    int
+	limits       Limits
+	podResources *podresources.Client
+	mu           sync.Mutex
+	allocations  map[string]*allocation
+}
+
+// NewManager creates the proxy manager for a resource. The proxy sockets are owned by the given group.
+// The proxies of allocations from a previous run of the plugin are restored, so that running containers
+// keep their access.
+func NewManager(l *zap.Logger, resourceName, devicePath, dir string, socketGID int, limits Limits, podResources *podresources.Client) (*Manager, error) {
+	m := &Manager{
+		l:            l,
+		resourceName: resourceName,
+		devicePath:   devicePath,
+		dir:          filepath.Join(dir, strings.ReplaceAll(resourceName, "/", "-")),
+		socketGID:    socketGID,
+		limits:       limits,
+		podResources: podResources,
+		allocations:  make(map[string]*allocation),
+	}
+	if err := os.MkdirAll(m.dir, 0o755); err != nil { // nolint: gosec
+		return nil, fmt.Errorf("creating proxy directory %s: %w", m.dir, err)
+	}
+	if err := m.restore(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Allocate starts the proxy for the given device IDs if it is not running yet, and returns the directory
+// on the host which contains its socket. The directory is supposed to be mounted into the container.
+func (m *Manager) Allocate(deviceIDs []string) (string, error) {
+	key, ids := allocationKey(deviceIDs)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a, ok := m.allocations[key]; ok {
+		// the devices were allocated again, protect them from the garbage collection again
+		a.allocated = time.Now()
+		return a.dir, nil
+	}
+	a, err := m.start(key, ids)
+	if err != nil {
+		return "", err
+	}
+	m.allocations[key] = a
+	return a.dir, nil
+}
+
+// allocationKey returns the key of an allocation and its sorted device IDs, so that the same devices
+// always get the same proxy regardless of their order
+func allocationKey(deviceIDs []string) (string, []string) {
+	ids := append([]string(nil), deviceIDs...)
+	sort.Strings(ids)
+	return strings.Join(ids, "_"), ids
+}
+
+func (m *Manager) start(key string, deviceIDs []string) (*allocation, error) {
+	dir := filepath.Join(m.dir, key)
+	if err := os.MkdirAll(dir, 0o755); err != nil { // nolint: gosec
+		return nil, fmt.Errorf("creating proxy directory %s: %w", dir, err)
+	}
+	p, err := newAllocationProxy(m.l.With(zap.Strings("deviceIDs", deviceIDs)), m.resourceName, m.devicePath, filepath.Join(dir, SocketName), m.socketGID, m.limits)
+	if err != nil {
+		return nil, err
+	}
+	return &allocation{
+		proxy:     p,
+		dir:       dir,
+		deviceIDs: deviceIDs,
+		allocated: time.Now(),
+	}, nil
+}
+
+// restore starts the proxies for all allocation directories which exist already
+func (m *Manager) restore() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return fmt.Errorf("reading proxy directory %s: %w", m.dir, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		a, err := m.start(e.Name(), strings.Split(e.Name(), "_"))
+		if err != nil {
+			return fmt.Errorf("restoring proxy: %w", err)
+		}
+		m.allocations[e.Name()] = a
+		m.l.Info("Restored proxy of allocation", zap.Strings("deviceIDs", a.deviceIDs))
+	}
+	return nil
+}
+
+// Run periodically removes the proxies of allocations which are no longer assigned to any container
+// until the context is cancelled. It does nothing without the PodResources client.
+func (m *Manager) Run(ctx context.Context) {
+	// caller safeguard
+	if m == nil || m.podResources == nil {
+		return
+	}
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := m.collect(ctx); err != nil {
+			m.l.Warn("Removing proxies of released allocations failed", zap.Error(err))
+		}
+	}
+}
+
+func (m *Manager) collect(ctx context.Context) error {
+	assignments, err := m.podResources.List(ctx)
+	if err != nil {
+		return err
+	}
+	assigned := assignedKeys(m.resourceName, assignments)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, a := range m.allocations {
+		// the proxy is removed unless a container was assigned exactly its devices, even if some of them
+		// were assigned to another container in the meantime
+		if _, ok := assigned[key]; ok || time.Since(a.allocated) < gcGracePeriod {
+			continue
+		}
+		a.proxy.close()
+		if err := os.RemoveAll(a.dir); err != nil {
+			m.l.Warn("Removing proxy directory failed", zap.String("dir", a.dir), zap.Error(err))
+		}
+		delete(m.allocations, key)
+		m.l.Info("Removed proxy of released allocation", zap.Strings("deviceIDs", a.deviceIDs))
+	}
+	return nil
+}
+
+// assignedKeys returns the allocation keys of the devices of the resource which are assigned to every container
+func assignedKeys(resourceName string, assignments []*podresources.Assignment) map[string]struct{} {
+	assigned := make(map[string]struct{})
+	for _, a := range assignments {
+		if a.ResourceName != resourceName {
+			continue
+		}
+		key, _ := allocationKey(a.DeviceIDs)
+		assigned[key] = struct{}{}
+	}
+	return assigned
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/podresources"
+
+	"go.uber.org/zap"
+)
+
+func newTestManager(t *testing.T, dir string, podResources *podresources.Client) *Manager {
+	t.Helper()
+	m, err := NewManager(zap.NewNop(), "githedgehog.com/tpmrm", "/dev/tpmrm0", dir, os.Getgid(), Limits{}, podResources)
+	if err != nil {
+		t.Fatalf("creating proxy manager: %v", err)
+	}
+	t.Cleanup(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, a := range m.allocations {
+			a.proxy.close()
+		}
+	})
+	return m
+}
+
+func TestManagerAllocate(t *testing.T) {
+	m := newTestManager(t, t.TempDir(), nil)
+
+	dir, err := m.Allocate([]string{"tpmrm0-2", "tpmrm0-1"})
+	if err != nil {
+		t.Fatalf("allocating: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, SocketName)); err != nil {
+		t.Errorf("proxy socket does not exist: %v", err)
+	}
+	// the same devices get the same proxy regardless of their order
+	again, err := m.Allocate([]string{"tpmrm0-1", "tpmrm0-2"})
+	if err != nil {
+		t.Fatalf("allocating again: %v", err)
+	}
+	if again != dir {
+		t.Errorf("expected the same proxy directory %s, got %s", dir, again)
+	}
+	other, err := m.Allocate([]string{"tpmrm0-3"})
+	if err != nil {
+		t.Fatalf("allocating other devices: %v", err)
+	}
+	if other == dir {
+		t.Errorf("expected a separate proxy directory for other devices, got %s", other)
+	}
+}
+
+func TestManagerRestore(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestManager(t, dir, nil)
+	allocated, err := m.Allocate([]string{"tpmrm0-1"})
+	if err != nil {
+		t.Fatalf("allocating: %v", err)
+	}
+
+	// a new run of the plugin restores the proxy of the existing allocation
+	restored := newTestManager(t, dir, nil)
+	if len(restored.allocations) != 1 {
+		t.Fatalf("expected 1 restored allocation, got %d", len(restored.allocations))
+	}
+	got, err := restored.Allocate([]string{"tpmrm0-1"})
+	if err != nil {
+		t.Fatalf("allocating restored devices: %v", err)
+	}
+	if got != allocated {
+		t.Errorf("expected the restored proxy directory %s, got %s", allocated, got)
+	}
+}
+
+func TestManagerRunStops(t *testing.T) {
+	origInterval := gcInterval
+	gcInterval = 10 * time.Millisecond
+	t.Cleanup(func() { gcInterval = origInterval })
+
+	// the kubelet socket does not exist, so every garbage collection fails, which keeps all proxies
+	m := newTestManager(t, t.TempDir(), podresources.New(filepath.Join(t.TempDir(), "kubelet.sock")))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+
+	time.Sleep(5 * gcInterval)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("garbage collection did not stop after the context was cancelled")
+	}
+}
+
+func TestAssignedKeys(t *testing.T) {
+	assigned := assignedKeys("githedgehog.com/tpmrm", []*podresources.Assignment{
+		{ResourceName: "githedgehog.com/tpmrm", DeviceIDs: []string{"tpmrm0-2", "tpmrm0-1"}},
+		{ResourceName: "githedgehog.com/tpmrm", DeviceIDs: []string{"tpmrm0-3"}},
+		{ResourceName: "githedgehog.com/tpm", DeviceIDs: []string{"tpmrm0-4"}},
+	})
+
+	tests := []struct {
+		deviceIDs []string
+		want      bool
+	}{
+		{deviceIDs: []string{"tpmrm0-1", "tpmrm0-2"}, want: true},
+		{deviceIDs: []string{"tpmrm0-3"}, want: true},
+		// only some of the devices are assigned, or they are assigned to different containers
+		{deviceIDs: []string{"tpmrm0-1"}, want: false},
+		{deviceIDs: []string{"tpmrm0-1", "tpmrm0-5"}, want: false},
+		{deviceIDs: []string{"tpmrm0-1", "tpmrm0-2", "tpmrm0-3"}, want: false},
+		// devices of other resources
+		{deviceIDs: []string{"tpmrm0-4"}, want: false},
+	}
+	for _, tt := range tests {
+		key, _ := allocationKey(tt.deviceIDs)
+		if _, got := assigned[key]; got != tt.want {
+			t.Errorf("allocation of %v: expected assigned %v, got %v", tt.deviceIDs, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package proxy implements the proxy-based access mode. Instead of the device node, every allocation gets a unix
+// socket which speaks the raw TPM command protocol (like the socket of swtpm). The proxy forwards the commands
+// to the device, and it limits the commands per second and the concurrent sessions of every allocation, so
+// that a single noisy workload cannot starve all others which share the TPM.
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// SocketName is the name of the proxy socket in the directory of an allocation
+	SocketName = "tpm.sock"
+	// ContainerDir is the path in containers where the directory of their allocation is mounted
+	ContainerDir = "/var/run/tpm"
+	// ContainerSocketPath is the path of the proxy socket in containers
+	ContainerSocketPath = ContainerDir + "/" + SocketName
+
+	// headerSize is the size of the header of TPM commands and responses: tag, size and command or response code
+	headerSize = 10
+	// maxBufferSize is the maximum size of TPM commands and responses that the kernel supports
+	maxBufferSize = 4096
+
+	// socketFileMode restricts the proxy sockets to root and the socket group
+	socketFileMode = 0o660
+)
+
+// Limits limit how much a single allocation can use the TPM
+type Limits struct {
+	// CommandsPerSecond is the rate of the token bucket for commands, unlimited if 0
+	CommandsPerSecond float64
+	// Burst is the size of the token bucket for commands
+	Burst int
+	// MaxSessions is the maximum number of concurrent connections, unlimited if 0
+	MaxSessions int
+}
+
+// errInvalidSize is returned for TPM commands whose size is out of range
+var errInvalidSize = errors.New("invalid TPM command size")
+
+// openDevice opens a session with the device
+var openDevice = func(devicePath string) (io.ReadWriteCloser, error) {
+	return os.OpenFile(devicePath, os.O_RDWR, 0)
+}
+
+// allocationProxy serves the proxy socket of a single allocation. Every connection is a session
+// with its own file descriptor of the device, so the in-kernel resource manager isolates them.
+type allocationProxy struct {
+	l            *zap.Logger
+	resourceName string
+	devicePath   string
+	limiter      *rate.Limiter
+	maxSessions  int
+	listener     net.Listener
+	mu           sync.Mutex
+	sessions     map[net.Conn]struct{}
+	wg           sync.WaitGroup
+}
+
+func newAllocationProxy(l *zap.Logger, resourceName, devicePath, socketPath string, socketGID int, limits Limits) (*allocationProxy, error) {
+	// a socket of a previous run of the plugin is stale, the container sees the new one through its directory mount
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("removing stale proxy socket %s: %w", socketPath, err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("listening on proxy socket %s: %w", socketPath, err)
+	}
+	// containers which do not run as root need the socket group as a supplemental group
+	if err := os.Chown(socketPath, -1, socketGID); err != nil {
+		listener.Close() // nolint: errcheck
+		return nil, fmt.Errorf("changing group of proxy socket %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, socketFileMode); err != nil {
+		listener.Close() // nolint: errcheck
+		return nil, fmt.Errorf("changing mode of proxy socket %s: %w", socketPath, err)
+	}
+
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if limits.CommandsPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(limits.CommandsPerSecond), limits.Burst)
+	}
+	p := &allocationProxy{
+		l:            l,
+		resourceName: resourceName,
+		devicePath:   devicePath,
+		limiter:      limiter,
+		maxSessions:  limits.MaxSessions,
+		listener:     listener,
+		sessions:     make(map[net.Conn]struct{}),
+	}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+func (p *allocationProxy) serve() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.l.Warn("Accepting proxy connection failed", zap.Error(err))
+			}
+			return
+		}
+		if !p.addSession(conn) {
+			p.l.Debug("Rejecting proxy session, too many concurrent sessions", zap.Int("maxSessions", p.maxSessions))
+			metrics.ProxyRejectedSessions.WithLabelValues(p.resourceName).Inc()
+			conn.Close() // nolint: errcheck
+			continue
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.removeSession(conn)
+			if err := p.session(conn); err != nil {
+				p.l.Debug("Proxy session failed", zap.Error(err))
+			}
+		}()
+	}
+}
+
+func (p *allocationProxy) addSession(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.maxSessions > 0 && len(p.sessions) >= p.maxSessions {
+		return false
+	}
+	p.sessions[conn] = struct{}{}
+	metrics.ProxySessions.WithLabelValues(p.resourceName).Inc()
+	return true
+}
+
+func (p *allocationProxy) removeSession(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.Close() // nolint: errcheck
+	delete(p.sessions, conn)
+	metrics.ProxySessions.WithLabelValues(p.resourceName).Dec()
+}
+
+// session forwards the commands of a connection to its own file descriptor of the device until the client disconnects
+func (p *allocationProxy) session(conn net.Conn) error {
+	dev, err := openDevice(p.devicePath)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", p.devicePath, err)
+	}
+	defer dev.Close() // nolint: errcheck
+
+	cmd := make([]byte, maxBufferSize)
+	rsp := make([]byte, maxBufferSize)
+	for {
+		n, err := readCommand(conn, cmd)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		// wait for a token, commands which have to wait are throttled
+		r := p.limiter.Reserve()
+		if d := r.Delay(); d > 0 {
+			metrics.ProxyThrottledCommands.WithLabelValues(p.resourceName).Inc()
+			time.Sleep(d)
+		}
+		metrics.ProxyCommands.WithLabelValues(p.resourceName).Inc()
+
+		if _, err := dev.Write(cmd[:n]); err != nil {
+			return fmt.Errorf("writing command to %s: %w", p.devicePath, err)
+		}
+		m, err := dev.Read(rsp)
+		if err != nil {
+			return fmt.Errorf("reading response from %s: %w", p.devicePath, err)
+		}
+		if _, err := conn.Write(rsp[:m]); err != nil {
+			return fmt.Errorf("writing response: %w", err)
+		}
+	}
+}
+
+// readCommand reads a complete TPM command into buf, and returns its size
+func readCommand(r io.Reader, buf []byte) (int, error) {
+	if _, err := io.ReadFull(r, buf[:headerSize]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint32(buf[2:6]))
+	if size < headerSize || size > len(buf) {
+		return 0, fmt.Errorf("%w %d", errInvalidSize, size)
+	}
+	if _, err := io.ReadFull(r, buf[headerSize:size]); err != nil {
+		return 0, fmt.Errorf("reading TPM command: %w", err)
+	}
+	return size, nil
+}
+
+// close stops accepting connections, and closes all sessions
+func (p *allocationProxy) close() {
+	p.listener.Close() // nolint: errcheck
+	p.mu.Lock()
+	for conn := range p.sessions {
+		conn.Close() // nolint: errcheck
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
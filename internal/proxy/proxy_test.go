@@ -0,0 +1,265 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// successResponse is the response of the fake device to every command
+var successResponse = []byte{0x80, 0x01, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00, 0x00}
+
+// command returns a TPM command with the given size in its header followed by the body
+func command(size uint32, body []byte) []byte {
+	ret := make([]byte, headerSize, headerSize+len(body))
+	binary.BigEndian.PutUint16(ret[0:2], 0x8001)
+	binary.BigEndian.PutUint32(ret[2:6], size)
+	binary.BigEndian.PutUint32(ret[6:10], 0x0000017b) // TPM2_GetRandom
+	return append(ret, body...)
+}
+
+// fakeDevice answers every command with a success response, and records the commands
+type fakeDevice struct {
+	mu       sync.Mutex
+	commands [][]byte
+}
+
+func (d *fakeDevice) Write(b []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.commands = append(d.commands, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (d *fakeDevice) Read(b []byte) (int, error) {
+	return copy(b, successResponse), nil
+}
+
+func (d *fakeDevice) Close() error {
+	return nil
+}
+
+func (d *fakeDevice) Commands() [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.commands
+}
+
+// newTestProxy starts a proxy whose sessions talk to the returned fake device
+func newTestProxy(t *testing.T, resourceName string, limits Limits) (*allocationProxy, string, *fakeDevice) {
+	t.Helper()
+	dev := &fakeDevice{}
+	orig := openDevice
+	openDevice = func(string) (io.ReadWriteCloser, error) { return dev, nil }
+	t.Cleanup(func() { openDevice = orig })
+
+	socketPath := filepath.Join(t.TempDir(), SocketName)
+	p, err := newAllocationProxy(zap.NewNop(), resourceName, "/dev/tpmrm0", socketPath, os.Getgid(), limits)
+	if err != nil {
+		t.Fatalf("creating proxy: %v", err)
+	}
+	t.Cleanup(p.close)
+	return p, socketPath, dev
+}
+
+func dial(t *testing.T, socketPath string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("connecting to proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() }) // nolint: errcheck
+	return conn
+}
+
+// roundTrip sends a command and reads the response
+func roundTrip(conn net.Conn, cmd []byte) ([]byte, error) {
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(cmd); err != nil {
+		return nil, err
+	}
+	rsp := make([]byte, len(successResponse))
+	if _, err := io.ReadFull(conn, rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    int
+		wantErr error
+	}{
+		{name: "header only", input: command(headerSize, nil), want: headerSize},
+		{name: "with body", input: command(headerSize+2, []byte{0x00, 0x20}), want: headerSize + 2},
+		{name: "maximum size", input: command(maxBufferSize, make([]byte, maxBufferSize-headerSize)), want: maxBufferSize},
+		{name: "trailing data of the next command", input: append(command(headerSize, nil), command(headerSize, nil)...), want: headerSize},
+		{name: "no data", input: nil, wantErr: io.EOF},
+		{name: "truncated header", input: command(headerSize, nil)[:5], wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated body", input: command(headerSize+4, []byte{0x00}), wantErr: io.ErrUnexpectedEOF},
+		{name: "size smaller than the header", input: command(headerSize-1, nil), wantErr: errInvalidSize},
+		{name: "size larger than the buffer", input: command(maxBufferSize+1, nil), wantErr: errInvalidSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, maxBufferSize)
+			n, err := readCommand(bytes.NewReader(tt.input), buf)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n != tt.want {
+				t.Fatalf("expected a command of %d bytes, got %d", tt.want, n)
+			}
+			if !bytes.Equal(buf[:n], tt.input[:n]) {
+				t.Errorf("expected command %x, got %x", tt.input[:n], buf[:n])
+			}
+		})
+	}
+}
+
+func TestSocketPermissions(t *testing.T) {
+	_, socketPath, _ := newTestProxy(t, "test/permissions", Limits{})
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("stat proxy socket: %v", err)
+	}
+	if mode := fi.Mode().Perm(); mode != socketFileMode {
+		t.Errorf("expected mode %o, got %o", socketFileMode, mode)
+	}
+	if gid := int(fi.Sys().(*syscall.Stat_t).Gid); gid != os.Getgid() {
+		t.Errorf("expected group %d, got %d", os.Getgid(), gid)
+	}
+}
+
+func TestForwardCommands(t *testing.T) {
+	_, socketPath, dev := newTestProxy(t, "test/forward", Limits{})
+	conn := dial(t, socketPath)
+
+	cmds := [][]byte{command(headerSize+2, []byte{0x00, 0x08}), command(headerSize, nil)}
+	for _, cmd := range cmds {
+		rsp, err := roundTrip(conn, cmd)
+		if err != nil {
+			t.Fatalf("sending command: %v", err)
+		}
+		if !bytes.Equal(rsp, successResponse) {
+			t.Errorf("expected response %x, got %x", successResponse, rsp)
+		}
+	}
+	got := dev.Commands()
+	if len(got) != len(cmds) {
+		t.Fatalf("expected %d commands on the device, got %d", len(cmds), len(got))
+	}
+	for i := range cmds {
+		if !bytes.Equal(got[i], cmds[i]) {
+			t.Errorf("command %d: expected %x, got %x", i, cmds[i], got[i])
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	const resourceName = "test/ratelimit"
+	const commands = 4
+	_, socketPath, _ := newTestProxy(t, resourceName, Limits{CommandsPerSecond: 20, Burst: 1})
+	conn := dial(t, socketPath)
+
+	throttled := testutil.ToFloat64(metrics.ProxyThrottledCommands.WithLabelValues(resourceName))
+	start := time.Now()
+	for i := 0; i < commands; i++ {
+		if _, err := roundTrip(conn, command(headerSize, nil)); err != nil {
+			t.Fatalf("sending command %d: %v", i, err)
+		}
+	}
+	// the burst allows the first command right away, every following one waits for a new token
+	if elapsed, min := time.Since(start), (commands-1)*50*time.Millisecond; elapsed < min*9/10 {
+		t.Errorf("expected %d commands to take at least %s, took %s", commands, min, elapsed)
+	}
+	if got := testutil.ToFloat64(metrics.ProxyThrottledCommands.WithLabelValues(resourceName)) - throttled; got != commands-1 {
+		t.Errorf("expected %d throttled commands, got %v", commands-1, got)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	const resourceName = "test/unlimited"
+	_, socketPath, _ := newTestProxy(t, resourceName, Limits{})
+	conn := dial(t, socketPath)
+
+	for i := 0; i < 50; i++ {
+		if _, err := roundTrip(conn, command(headerSize, nil)); err != nil {
+			t.Fatalf("sending command %d: %v", i, err)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.ProxyThrottledCommands.WithLabelValues(resourceName)); got != 0 {
+		t.Errorf("expected no throttled commands, got %v", got)
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	const resourceName = "test/maxsessions"
+	_, socketPath, _ := newTestProxy(t, resourceName, Limits{MaxSessions: 1})
+
+	// the first session is established once it answered a command
+	first := dial(t, socketPath)
+	if _, err := roundTrip(first, command(headerSize, nil)); err != nil {
+		t.Fatalf("sending command in the first session: %v", err)
+	}
+
+	second := dial(t, socketPath)
+	if _, err := roundTrip(second, command(headerSize, nil)); err == nil {
+		t.Fatal("expected the second session to be closed")
+	}
+	if got := testutil.ToFloat64(metrics.ProxyRejectedSessions.WithLabelValues(resourceName)); got != 1 {
+		t.Errorf("expected 1 rejected session, got %v", got)
+	}
+
+	// a new session is accepted once the first one is gone
+	first.Close() // nolint: errcheck
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := roundTrip(dial(t, socketPath), command(headerSize, nil)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new session was not accepted after the first session was closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
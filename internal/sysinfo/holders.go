@@ -0,0 +1,76 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sysinfo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Proc is the mount point of procfs
+const Proc = "/proc"
+
+// DeviceHolders returns the PIDs of all processes which hold the device node at the given path open. It scans
+// the file descriptors of all processes in procfs, so it never opens the device itself. It only sees the processes
+// of the PID namespace of the caller, and it skips processes whose file descriptors it is not allowed to read,
+// which it reports as the number of skipped processes.
+func DeviceHolders(devicePath string) ([]int, int, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(devicePath, &st); err != nil {
+		return nil, 0, fmt.Errorf("stat %s: %w", devicePath, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		return nil, 0, fmt.Errorf("%s is not a character device", devicePath)
+	}
+
+	entries, err := os.ReadDir(Proc)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading %s: %w", Proc, err)
+	}
+	self := os.Getpid()
+	var holders []int
+	var skipped int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		fdDir := filepath.Join(Proc, entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// the process exited in the meantime, or we lack the permissions to read its file descriptors
+			if !os.IsNotExist(err) {
+				skipped++
+			}
+			continue
+		}
+		for _, fd := range fds {
+			var fdst syscall.Stat_t
+			if err := syscall.Stat(filepath.Join(fdDir, fd.Name()), &fdst); err != nil {
+				continue
+			}
+			if fdst.Mode&syscall.S_IFMT == syscall.S_IFCHR && fdst.Rdev == st.Rdev {
+				holders = append(holders, pid)
+				break
+			}
+		}
+	}
+	return holders, skipped, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sysinfo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SysDevChar is the sysfs directory which links every character device number to its device
+	SysDevChar = "/sys/dev/char"
+	// SysDevices is the root of the sysfs device hierarchy
+	SysDevices = "/sys/devices"
+
+	numaNodeFile = "numa_node"
+)
+
+// NUMANode returns the NUMA node of the device node at the given path, or -1 if it has no NUMA affinity.
+// The device node is resolved through its device number, so that it also works for remapped device
+// paths. TPM devices rarely have a NUMA node themselves, so it walks up the parent devices until one of
+// them has a NUMA node (e.g. the PCI device of a CRB TPM).
+func NUMANode(devicePath string) (int, error) {
+	dir, err := sysfsDevice(devicePath)
+	if err != nil {
+		return -1, err
+	}
+	for ; strings.HasPrefix(dir, SysDevices+"/"); dir = filepath.Dir(dir) {
+		b, err := os.ReadFile(filepath.Join(dir, numaNodeFile))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return -1, err
+		}
+		node, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return -1, fmt.Errorf("parsing %s: %w", filepath.Join(dir, numaNodeFile), err)
+		}
+		// the kernel reports -1 for devices without NUMA affinity, there is no point in looking further
+		return node, nil
+	}
+	return -1, nil
+}
+
+// sysfsDevice resolves the sysfs device directory of the character device node at the given path
+// through its device number
+func sysfsDevice(devicePath string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(devicePath, &st); err != nil {
+		return "", fmt.Errorf("stat %s: %w", devicePath, err)
+	}
+	link := filepath.Join(SysDevChar, fmt.Sprintf("%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev)))
+	dir, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return "", fmt.Errorf("resolving sysfs device of %s: %w", devicePath, err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sysinfo detects the properties of the node which decide which TPM devices can be exposed:
+// the kernel version, the TPM family of the TPM, and if the in-kernel resource manager is available.
+package sysinfo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// TPMFamily is the TPM specification family that a TPM implements
+type TPMFamily string
+
+const (
+	// TPMFamilyUnknown means that there is either no TPM, or that its family could not be detected
+	TPMFamilyUnknown TPMFamily = "unknown"
+	TPMFamily12      TPMFamily = "1.2"
+	TPMFamily20      TPMFamily = "2.0"
+)
+
+const (
+	// SysClassTPM is the sysfs class directory of all TPM devices
+	SysClassTPM = "/sys/class/tpm"
+
+	tpmDevice         = "tpm0"
+	tpmDevicePrefix   = "tpm"
+	tpmrmDevicePrefix = "tpmrm"
+	tpmrmDevicePath   = "/dev/tpmrm0"
+	rmKernelMajor     = 4
+	rmKernelMinor     = 12
+	versionMajorFile  = "tpm_version_major"
+	// the caps file only exists for TPM 1.2 devices
+	capsFile = "caps"
+)
+
+// Info are the detected properties of the node
+type Info struct {
+	// KernelRelease is the kernel release as reported by uname
+	KernelRelease string
+	KernelMajor   int
+	KernelMinor   int
+	// TPMFamily is the family of the tpm0 device
+	TPMFamily TPMFamily
+	// ResourceManager is true if the /dev/tpmrm0 device of the in-kernel resource manager exists
+	ResourceManager bool
+}
+
+// Detect detects the properties of the node
+func Detect() (*Info, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return nil, fmt.Errorf("uname: %w", err)
+	}
+	release := unix.ByteSliceToString(uts.Release[:])
+	major, minor, err := parseKernelRelease(release)
+	if err != nil {
+		return nil, err
+	}
+
+	family, err := DetectTPMFamily(filepath.Join(SysClassTPM, tpmDevice))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(tpmrmDevicePath)
+	return &Info{
+		KernelRelease:   release,
+		KernelMajor:     major,
+		KernelMinor:     minor,
+		TPMFamily:       family,
+		ResourceManager: err == nil,
+	}, nil
+}
+
+// KernelSupportsResourceManager returns true if the kernel is recent enough for the in-kernel resource manager
+func (i *Info) KernelSupportsResourceManager() bool {
+	return i.KernelMajor > rmKernelMajor || (i.KernelMajor == rmKernelMajor && i.KernelMinor >= rmKernelMinor)
+}
+
+// DetectTPMFamily detects the family of the TPM with the given sysfs directory (e.g. /sys/class/tpm/tpm0).
+// Newer kernels expose the family in the 'tpm_version_major' file. For older kernels we fall back to the
+// 'caps' file which only exists for TPM 1.2 devices. It returns TPMFamilyUnknown if there is no such TPM, or
+// if the family cannot be detected.
+func DetectTPMFamily(sysfsDir string) (TPMFamily, error) {
+	if _, err := os.Stat(sysfsDir); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return TPMFamilyUnknown, nil
+		}
+		return TPMFamilyUnknown, fmt.Errorf("detecting TPM family: %w", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(sysfsDir, versionMajorFile))
+	if err == nil {
+		switch strings.TrimSpace(string(b)) {
+		case "1":
+			return TPMFamily12, nil
+		case "2":
+			return TPMFamily20, nil
+		default:
+			return TPMFamilyUnknown, nil
+		}
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return TPMFamilyUnknown, fmt.Errorf("detecting TPM family: %w", err)
+	}
+
+	// depending on the kernel, the caps file is in the class directory or in the directory of the device
+	for _, path := range []string{filepath.Join(sysfsDir, capsFile), filepath.Join(sysfsDir, "device", capsFile)} {
+		if _, err := os.Stat(path); err == nil {
+			return TPMFamily12, nil
+		}
+	}
+	// without either file, a TPM 1.2 cannot be told apart from a TPM 2.0 on old kernels
+	return TPMFamilyUnknown, nil
+}
+
+// DeviceTPMFamily detects the family of the TPM behind the given device node (e.g. /dev/tpm1 or /dev/tpmrm0).
+// The device node is resolved through sysfs, so that it also works for remapped device paths. The resource manager
+// device of a TPM 1.2 does not exist, so a missing tpmrmN device falls back to the tpmN device of the same TPM.
+// It returns TPMFamilyUnknown if there is no such TPM.
+func DeviceTPMFamily(devicePath string) (TPMFamily, error) {
+	name := filepath.Base(devicePath)
+	dir, err := sysfsDevice(devicePath)
+	switch {
+	case err == nil:
+		name = filepath.Base(dir)
+	case !errors.Is(err, os.ErrNotExist):
+		return TPMFamilyUnknown, err
+	}
+	if strings.HasPrefix(name, tpmrmDevicePrefix) {
+		name = tpmDevicePrefix + strings.TrimPrefix(name, tpmrmDevicePrefix)
+	}
+	if !strings.HasPrefix(name, tpmDevicePrefix) {
+		return TPMFamilyUnknown, nil
+	}
+	return DetectTPMFamily(filepath.Join(SysClassTPM, name))
+}
+
+// parseKernelRelease parses the major and minor version of a kernel release like '6.2.15-300.fc38.x86_64'
+func parseKernelRelease(release string) (int, int, error) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("unsupported kernel release '%s'", release)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("unsupported kernel release '%s': %w", release, err)
+	}
+	// the minor version can have a suffix if there is no patch level
+	minorStr := parts[1]
+	if i := strings.IndexFunc(minorStr, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minorStr = minorStr[:i]
+	}
+	minor, err := strconv.Atoi(minorStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unsupported kernel release '%s': %w", release, err)
+	}
+	return major, minor, nil
+}
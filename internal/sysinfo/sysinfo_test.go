@@ -0,0 +1,66 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sysinfo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectTPMFamily(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  TPMFamily
+	}{
+		{name: "version 2", files: map[string]string{"tpm_version_major": "2\n"}, want: TPMFamily20},
+		{name: "version 1", files: map[string]string{"tpm_version_major": "1\n", "caps": ""}, want: TPMFamily12},
+		{name: "unsupported version", files: map[string]string{"tpm_version_major": "3\n"}, want: TPMFamilyUnknown},
+		{name: "caps in the class directory", files: map[string]string{"caps": ""}, want: TPMFamily12},
+		{name: "caps in the device directory", files: map[string]string{"device/caps": ""}, want: TPMFamily12},
+		{name: "neither version nor caps", files: map[string]string{"dev": "10:224\n"}, want: TPMFamilyUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "tpm0")
+			for name, content := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatalf("creating %s: %v", filepath.Dir(path), err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0o644); err != nil { // nolint: gosec
+					t.Fatalf("writing %s: %v", path, err)
+				}
+			}
+			got, err := DetectTPMFamily(dir)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected family %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("no TPM", func(t *testing.T) {
+		got, err := DetectTPMFamily(filepath.Join(t.TempDir(), "tpm0"))
+		if err != nil || got != TPMFamilyUnknown {
+			t.Errorf("expected an unknown family without error, got %s, %v", got, err)
+		}
+	})
+}
@@ -0,0 +1,353 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook implements a mutating admission webhook for pods. It translates a pod annotation into
+// TPM resource requests, and it rejects pods which request restricted TPM resources from namespaces
+// which are not allowed to use them.
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.githedgehog.com/k8s-tpm-device-plugin/internal/config"
+
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AnnotationInject requests a TPM resource for a pod, e.g. 'tpmrm' for 'githedgehog.com/tpmrm',
+	// or a full resource name like 'example.com/attestation-tpm'
+	AnnotationInject = "tpm.githedgehog.com/inject"
+	// AnnotationContainers is a comma separated list of the containers which get the TPM resource,
+	// defaults to the first container of the pod
+	AnnotationContainers = "tpm.githedgehog.com/containers"
+
+	// EventLogPath is the TPM event log of the firmware on the host which is mounted into containers
+	EventLogPath = "/sys/kernel/security/tpm0/binary_bios_measurements"
+	// EventLogContainerPath is the path of the TPM event log in containers
+	// NOTE: this must be outside of /sys, as sysfs is read-only in containers and securityfs is not mounted
+	EventLogContainerPath = "/var/run/tpm-event-log/binary_bios_measurements"
+	// EventLogEnvVar tells the workload where to find the TPM event log
+	EventLogEnvVar = "TPM_EVENT_LOG"
+
+	defaultResourceDomain = "githedgehog.com/"
+	eventLogVolume        = "tpm-event-log"
+	tctiEnvVar            = "TPM2TOOLS_TCTI"
+
+	// maxRequestSize limits the size of admission reviews that we read
+	maxRequestSize = 4 << 20
+)
+
+// Config configures the webhook
+type Config struct {
+	// InjectEventLog mounts the TPM event log of the host into containers which get a TPM resource injected
+	InjectEventLog bool
+	// RestrictedResources are the resources which only pods in the allowed namespaces can request
+	RestrictedResources []string
+	// AllowedNamespaces are the namespaces which can request restricted resources,
+	// the restriction is disabled if there are none
+	AllowedNamespaces []string
+}
+
+// Webhook serves admission reviews for pods
+type Webhook struct {
+	l                 *zap.Logger
+	injectEventLog    bool
+	restricted        map[corev1.ResourceName]struct{}
+	allowedNamespaces map[string]struct{}
+}
+
+// New creates the webhook
+func New(l *zap.Logger, cfg Config) *Webhook {
+	w := &Webhook{
+		l:                 l,
+		injectEventLog:    cfg.InjectEventLog,
+		restricted:        make(map[corev1.ResourceName]struct{}, len(cfg.RestrictedResources)),
+		allowedNamespaces: make(map[string]struct{}, len(cfg.AllowedNamespaces)),
+	}
+	for _, r := range cfg.RestrictedResources {
+		w.restricted[corev1.ResourceName(r)] = struct{}{}
+	}
+	for _, ns := range cfg.AllowedNamespaces {
+		w.allowedNamespaces[ns] = struct{}{}
+	}
+	return w
+}
+
+// ServeHTTP implements http.Handler for admission reviews
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("reading request: %s", err), http.StatusBadRequest)
+		return
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(b, &review); err != nil {
+		http.Error(rw, fmt.Sprintf("parsing admission review: %s", err), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(rw, "admission review without request", http.StatusBadRequest)
+		return
+	}
+
+	resp := w.review(review.Request)
+	resp.UID = review.Request.UID
+	review.Response = resp
+	review.Request = nil
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(&review); err != nil {
+		w.l.Debug("Writing admission review response failed", zap.Error(err))
+	}
+}
+
+// review mutates and validates the pod of an admission request
+func (w *Webhook) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	l := w.l.With(zap.String("namespace", req.Namespace), zap.String("name", req.Name), zap.String("uid", string(req.UID)))
+	if req.Kind.Kind != "Pod" || req.Operation != admissionv1.Create {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return deny(http.StatusBadRequest, fmt.Sprintf("parsing pod: %s", err))
+	}
+
+	ops, err := w.mutate(&pod)
+	if err != nil {
+		l.Info("Rejecting pod", zap.Error(err))
+		return deny(http.StatusBadRequest, err.Error())
+	}
+	// NOTE: validate after the mutation, so that injected resources are validated as well
+	if err := w.validate(req.Namespace, &pod); err != nil {
+		l.Info("Rejecting pod", zap.Error(err))
+		return deny(http.StatusForbidden, err.Error())
+	}
+	if len(ops) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return deny(http.StatusInternalServerError, fmt.Sprintf("creating patch: %s", err))
+	}
+	l.Info("Injected TPM resource into pod", zap.String("resourceName", pod.Annotations[AnnotationInject]))
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patch,
+		PatchType: &patchType,
+	}
+}
+
+// patchOp is a JSON patch operation (RFC 6902)
+type patchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// addOp returns the JSON patch operation which adds the value at the path
+func addOp(path string, value any) patchOp {
+	return patchOp{Op: "add", Path: path, Value: value}
+}
+
+// appendOp returns the JSON patch operation which appends the value to the list at the path. It
+// creates the list if it does not exist yet.
+func appendOp(path string, exists bool, value any) patchOp {
+	if !exists {
+		return addOp(path, []any{value})
+	}
+	return addOp(path+"/-", value)
+}
+
+// escapePointer escapes a reference token of a JSON pointer (RFC 6901)
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// mutate injects the TPM resource which is requested with the inject annotation into the pod.
+// It returns the JSON patch operations for everything that it changed, so that the patch only touches
+// the containers and fields that it injects into.
+func (w *Webhook) mutate(pod *corev1.Pod) ([]patchOp, error) {
+	inject := strings.TrimSpace(pod.Annotations[AnnotationInject])
+	if inject == "" {
+		return nil, nil
+	}
+	resourceName, devicePath := resolveResource(inject)
+
+	containers := []string{}
+	if v := pod.Annotations[AnnotationContainers]; v != "" {
+		for _, name := range strings.Split(v, ",") {
+			containers = append(containers, strings.TrimSpace(name))
+		}
+	} else if len(pod.Spec.Containers) > 0 {
+		containers = append(containers, pod.Spec.Containers[0].Name)
+	}
+
+	var ops []patchOp
+	for _, name := range containers {
+		i := findContainer(pod, name)
+		if i < 0 {
+			return nil, fmt.Errorf("annotation %s: container %s does not exist", AnnotationContainers, name)
+		}
+		c := &pod.Spec.Containers[i]
+		path := fmt.Sprintf("/spec/containers/%d", i)
+		if c.Resources.Limits == nil {
+			c.Resources.Limits = corev1.ResourceList{resourceName: resource.MustParse("1")}
+			ops = append(ops, addOp(path+"/resources/limits", c.Resources.Limits))
+		} else if _, ok := c.Resources.Limits[resourceName]; !ok {
+			c.Resources.Limits[resourceName] = resource.MustParse("1")
+			ops = append(ops, addOp(path+"/resources/limits/"+escapePointer(string(resourceName)), c.Resources.Limits[resourceName]))
+		}
+		if devicePath != "" && !hasEnv(c, tctiEnvVar) {
+			env := corev1.EnvVar{Name: tctiEnvVar, Value: "device:" + devicePath}
+			ops = append(ops, appendOp(path+"/env", c.Env != nil, env))
+			c.Env = append(c.Env, env)
+		}
+		if w.injectEventLog && !hasVolumeMount(c, eventLogVolume) {
+			mount := corev1.VolumeMount{
+				Name:      eventLogVolume,
+				MountPath: EventLogContainerPath,
+				ReadOnly:  true,
+			}
+			ops = append(ops, appendOp(path+"/volumeMounts", c.VolumeMounts != nil, mount))
+			c.VolumeMounts = append(c.VolumeMounts, mount)
+		}
+		if w.injectEventLog && !hasEnv(c, EventLogEnvVar) {
+			env := corev1.EnvVar{Name: EventLogEnvVar, Value: EventLogContainerPath}
+			ops = append(ops, appendOp(path+"/env", c.Env != nil, env))
+			c.Env = append(c.Env, env)
+		}
+	}
+
+	if w.injectEventLog && !hasVolume(pod, eventLogVolume) {
+		hostPathType := corev1.HostPathFile
+		volume := corev1.Volume{
+			Name: eventLogVolume,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: EventLogPath,
+					Type: &hostPathType,
+				},
+			},
+		}
+		ops = append(ops, appendOp("/spec/volumes", pod.Spec.Volumes != nil, volume))
+		pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+	}
+	return ops, nil
+}
+
+// validate rejects pods which request restricted resources from namespaces which are not allowed to
+func (w *Webhook) validate(namespace string, pod *corev1.Pod) error {
+	if len(w.allowedNamespaces) == 0 {
+		return nil
+	}
+	if _, ok := w.allowedNamespaces[namespace]; ok {
+		return nil
+	}
+	containers := make([]corev1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	containers = append(containers, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	for _, c := range containers {
+		for name := range c.Resources.Limits {
+			if _, ok := w.restricted[name]; ok {
+				return fmt.Errorf("container %s: namespace %s is not allowed to request %s", c.Name, namespace, name)
+			}
+		}
+		for name := range c.Resources.Requests {
+			if _, ok := w.restricted[name]; ok {
+				return fmt.Errorf("container %s: namespace %s is not allowed to request %s", c.Name, namespace, name)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveResource returns the resource name for the value of the inject annotation, and the device
+// path for the TCTI environment variable. The device path is empty for unknown resources.
+func resolveResource(inject string) (corev1.ResourceName, string) {
+	if strings.Contains(inject, "/") {
+		return corev1.ResourceName(inject), ""
+	}
+	switch config.Kind(inject) {
+	case config.KindTPMRM:
+		return corev1.ResourceName(defaultResourceDomain + inject), config.TPMRMDevicePath
+	case config.KindTPM:
+		return corev1.ResourceName(defaultResourceDomain + inject), config.TPMDevicePath
+	default:
+		return corev1.ResourceName(defaultResourceDomain + inject), ""
+	}
+}
+
+func deny(code int32, msg string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Message: msg,
+		},
+	}
+}
+
+// findContainer returns the index of the container with the given name, or -1 if it does not exist
+func findContainer(pod *corev1.Pod, name string) int {
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasEnv(c *corev1.Container, name string) bool {
+	for _, env := range c.Env {
+		if env.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVolumeMount(c *corev1.Container, name string) bool {
+	for _, m := range c.VolumeMounts {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVolume(pod *corev1.Pod, name string) bool {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,387 @@
+/*
+Copyright 2023 Hedgehog SONiC Foundation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const tpmrmResource = corev1.ResourceName("githedgehog.com/tpmrm")
+
+func testPod(annotations map[string]string, containers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", Annotations: annotations},
+		Spec:       corev1.PodSpec{Containers: containers},
+	}
+}
+
+func testRequest(t *testing.T, namespace string, pod *corev1.Pod) *admissionv1.AdmissionRequest {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("marshaling pod: %v", err)
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:       "uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: namespace,
+		Name:      pod.Name,
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+// applyPatch applies the patch of an admission response to the pod of the request like the API server
+func applyPatch(t *testing.T, req *admissionv1.AdmissionRequest, resp *admissionv1.AdmissionResponse) *corev1.Pod {
+	t.Helper()
+	raw := req.Object.Raw
+	if resp.Patch != nil {
+		if resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch {
+			t.Fatalf("unexpected patch type %v", resp.PatchType)
+		}
+		var ops []map[string]any
+		if err := json.Unmarshal(resp.Patch, &ops); err != nil {
+			t.Fatalf("parsing patch: %v", err)
+		}
+		for _, op := range ops {
+			if op["path"] == "/spec/containers" {
+				t.Errorf("patch replaces all containers: %v", op)
+			}
+		}
+		patch, err := jsonpatch.DecodePatch(resp.Patch)
+		if err != nil {
+			t.Fatalf("decoding patch: %v", err)
+		}
+		if raw, err = patch.Apply(raw); err != nil {
+			t.Fatalf("applying patch %s: %v", resp.Patch, err)
+		}
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(raw, &pod); err != nil {
+		t.Fatalf("parsing patched pod: %v", err)
+	}
+	return &pod
+}
+
+func expectLimit(t *testing.T, c corev1.Container, name corev1.ResourceName, value string) {
+	t.Helper()
+	q, ok := c.Resources.Limits[name]
+	if !ok {
+		t.Errorf("container %s: no limit for %s", c.Name, name)
+		return
+	}
+	if q.Cmp(resource.MustParse(value)) != 0 {
+		t.Errorf("container %s: expected limit %s for %s, got %s", c.Name, value, name, q.String())
+	}
+}
+
+func TestMutate(t *testing.T) {
+	l := zap.NewNop()
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		pod    *corev1.Pod
+		verify func(t *testing.T, pod *corev1.Pod)
+	}{
+		{
+			name: "without annotation",
+			pod:  testPod(nil, corev1.Container{Name: "app"}),
+			verify: func(t *testing.T, pod *corev1.Pod) {
+				if len(pod.Spec.Containers[0].Resources.Limits) != 0 {
+					t.Errorf("expected no limits, got %v", pod.Spec.Containers[0].Resources.Limits)
+				}
+			},
+		},
+		{
+			name: "first container",
+			pod: testPod(map[string]string{AnnotationInject: "tpmrm"},
+				corev1.Container{Name: "app"},
+				corev1.Container{Name: "sidecar", Env: []corev1.EnvVar{{Name: "FOO", Value: "bar"}}},
+			),
+			verify: func(t *testing.T, pod *corev1.Pod) {
+				app := pod.Spec.Containers[0]
+				expectLimit(t, app, tpmrmResource, "1")
+				if len(app.Env) != 1 || app.Env[0].Name != tctiEnvVar || app.Env[0].Value != "device:/dev/tpmrm0" {
+					t.Errorf("expected the TCTI env var, got %v", app.Env)
+				}
+				sidecar := pod.Spec.Containers[1]
+				if len(sidecar.Resources.Limits) != 0 || len(sidecar.Env) != 1 {
+					t.Errorf("expected the sidecar to be unchanged, got %+v", sidecar)
+				}
+				if len(pod.Spec.Volumes) != 0 {
+					t.Errorf("expected no volumes, got %v", pod.Spec.Volumes)
+				}
+			},
+		},
+		{
+			name: "existing limits and env",
+			pod: testPod(map[string]string{AnnotationInject: "tpmrm"},
+				corev1.Container{
+					Name: "app",
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+					},
+					Env: []corev1.EnvVar{{Name: "FOO", Value: "bar"}},
+				},
+			),
+			verify: func(t *testing.T, pod *corev1.Pod) {
+				app := pod.Spec.Containers[0]
+				expectLimit(t, app, corev1.ResourceCPU, "100m")
+				expectLimit(t, app, tpmrmResource, "1")
+				if len(app.Env) != 2 || app.Env[0].Name != "FOO" || app.Env[1].Name != tctiEnvVar {
+					t.Errorf("expected the TCTI env var to be appended, got %v", app.Env)
+				}
+			},
+		},
+		{
+			name: "requested already",
+			pod: testPod(map[string]string{AnnotationInject: "tpmrm"},
+				corev1.Container{
+					Name: "app",
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{tpmrmResource: resource.MustParse("2")},
+					},
+					Env: []corev1.EnvVar{{Name: tctiEnvVar, Value: "tabrmd"}},
+				},
+			),
+			verify: func(t *testing.T, pod *corev1.Pod) {
+				app := pod.Spec.Containers[0]
+				expectLimit(t, app, tpmrmResource, "2")
+				if len(app.Env) != 1 || app.Env[0].Value != "tabrmd" {
+					t.Errorf("expected the TCTI env var to be unchanged, got %v", app.Env)
+				}
+			},
+		},
+		{
+			name: "selected containers with a custom resource",
+			pod: testPod(map[string]string{AnnotationInject: "example.com/attestation-tpm", AnnotationContainers: "b, c"},
+				corev1.Container{Name: "a"},
+				corev1.Container{Name: "b"},
+				corev1.Container{Name: "c"},
+			),
+			verify: func(t *testing.T, pod *corev1.Pod) {
+				if len(pod.Spec.Containers[0].Resources.Limits) != 0 {
+					t.Errorf("expected container a to be unchanged, got %v", pod.Spec.Containers[0].Resources.Limits)
+				}
+				for _, c := range pod.Spec.Containers[1:] {
+					expectLimit(t, c, "example.com/attestation-tpm", "1")
+					if len(c.Env) != 0 {
+						t.Errorf("container %s: expected no TCTI env var for a custom resource, got %v", c.Name, c.Env)
+					}
+				}
+			},
+		},
+		{
+			name: "event log",
+			cfg:  Config{InjectEventLog: true},
+			pod: func() *corev1.Pod {
+				pod := testPod(map[string]string{AnnotationInject: "tpm"},
+					corev1.Container{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}},
+				)
+				pod.Spec.Volumes = []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+				return pod
+			}(),
+			verify: func(t *testing.T, pod *corev1.Pod) {
+				app := pod.Spec.Containers[0]
+				expectLimit(t, app, "githedgehog.com/tpm", "1")
+				if len(app.Env) != 2 || app.Env[0].Value != "device:/dev/tpm0" {
+					t.Errorf("expected the TCTI env var, got %v", app.Env)
+				}
+				if len(app.Env) != 2 || app.Env[1].Name != EventLogEnvVar || app.Env[1].Value != "/var/run/tpm-event-log/binary_bios_measurements" {
+					t.Errorf("expected the event log env var, got %v", app.Env)
+				}
+				if len(app.VolumeMounts) != 2 || app.VolumeMounts[0].Name != "data" {
+					t.Fatalf("expected the event log mount to be appended, got %v", app.VolumeMounts)
+				}
+				// sysfs is read-only in containers, the event log must be mounted somewhere else
+				if got := app.VolumeMounts[1].MountPath; got != "/var/run/tpm-event-log/binary_bios_measurements" || strings.HasPrefix(got, "/sys/") {
+					t.Errorf("expected the event log to be mounted outside of /sys, got %s", got)
+				}
+				if !app.VolumeMounts[1].ReadOnly {
+					t.Error("expected the event log to be mounted read-only")
+				}
+				if len(pod.Spec.Volumes) != 2 || pod.Spec.Volumes[0].Name != "data" || pod.Spec.Volumes[1].HostPath == nil {
+					t.Fatalf("expected the event log volume to be appended, got %v", pod.Spec.Volumes)
+				}
+				if got := pod.Spec.Volumes[1].HostPath.Path; got != EventLogPath {
+					t.Errorf("expected the event log of the host at %s, got %s", EventLogPath, got)
+				}
+			},
+		},
+		{
+			name: "event log without volumes",
+			cfg:  Config{InjectEventLog: true},
+			pod:  testPod(map[string]string{AnnotationInject: "tpmrm"}, corev1.Container{Name: "app"}),
+			verify: func(t *testing.T, pod *corev1.Pod) {
+				if len(pod.Spec.Containers[0].VolumeMounts) != 1 || pod.Spec.Containers[0].VolumeMounts[0].MountPath != EventLogContainerPath {
+					t.Errorf("expected the event log mount, got %v", pod.Spec.Containers[0].VolumeMounts)
+				}
+				if len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].Name != eventLogVolume {
+					t.Errorf("expected the event log volume, got %v", pod.Spec.Volumes)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testRequest(t, "default", tt.pod)
+			resp := New(l, tt.cfg).review(req)
+			if !resp.Allowed {
+				t.Fatalf("expected the pod to be allowed, got: %v", resp.Result)
+			}
+			tt.verify(t, applyPatch(t, req, resp))
+		})
+	}
+}
+
+func TestMutateUnknownContainer(t *testing.T) {
+	pod := testPod(map[string]string{AnnotationInject: "tpmrm", AnnotationContainers: "app,missing"}, corev1.Container{Name: "app"})
+	resp := New(zap.NewNop(), Config{}).review(testRequest(t, "default", pod))
+	if resp.Allowed {
+		t.Fatal("expected the pod to be rejected")
+	}
+	if resp.Result.Code != http.StatusBadRequest {
+		t.Errorf("expected code %d, got %d", http.StatusBadRequest, resp.Result.Code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Config{
+		RestrictedResources: []string{"githedgehog.com/tpm"},
+		AllowedNamespaces:   []string{"attestation"},
+	}
+	restricted := corev1.ResourceList{"githedgehog.com/tpm": resource.MustParse("1")}
+
+	tests := []struct {
+		name      string
+		cfg       Config
+		namespace string
+		pod       *corev1.Pod
+		allowed   bool
+	}{
+		{
+			name:      "unrestricted resource",
+			cfg:       cfg,
+			namespace: "default",
+			pod:       testPod(map[string]string{AnnotationInject: "tpmrm"}, corev1.Container{Name: "app"}),
+			allowed:   true,
+		},
+		{
+			name:      "restricted limit",
+			cfg:       cfg,
+			namespace: "default",
+			pod:       testPod(nil, corev1.Container{Name: "app", Resources: corev1.ResourceRequirements{Limits: restricted}}),
+		},
+		{
+			name:      "restricted request",
+			cfg:       cfg,
+			namespace: "default",
+			pod:       testPod(nil, corev1.Container{Name: "app", Resources: corev1.ResourceRequirements{Requests: restricted}}),
+		},
+		{
+			name:      "restricted init container",
+			cfg:       cfg,
+			namespace: "default",
+			pod: func() *corev1.Pod {
+				pod := testPod(nil, corev1.Container{Name: "app"})
+				pod.Spec.InitContainers = []corev1.Container{{Name: "init", Resources: corev1.ResourceRequirements{Limits: restricted}}}
+				return pod
+			}(),
+		},
+		{
+			name:      "restricted injection",
+			cfg:       cfg,
+			namespace: "default",
+			pod:       testPod(map[string]string{AnnotationInject: "tpm"}, corev1.Container{Name: "app"}),
+		},
+		{
+			name:      "allowed namespace",
+			cfg:       cfg,
+			namespace: "attestation",
+			pod:       testPod(map[string]string{AnnotationInject: "tpm"}, corev1.Container{Name: "app"}),
+			allowed:   true,
+		},
+		{
+			name:      "restriction disabled",
+			cfg:       Config{RestrictedResources: cfg.RestrictedResources},
+			namespace: "default",
+			pod:       testPod(nil, corev1.Container{Name: "app", Resources: corev1.ResourceRequirements{Limits: restricted}}),
+			allowed:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := New(zap.NewNop(), tt.cfg).review(testRequest(t, tt.namespace, tt.pod))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("expected allowed=%t, got %t: %v", tt.allowed, resp.Allowed, resp.Result)
+			}
+			if !tt.allowed && resp.Result.Code != http.StatusForbidden {
+				t.Errorf("expected code %d, got %d", http.StatusForbidden, resp.Result.Code)
+			}
+		})
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	w := New(zap.NewNop(), Config{})
+	req := testRequest(t, "default", testPod(map[string]string{AnnotationInject: "tpmrm"}, corev1.Container{Name: "app"}))
+	body, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	})
+	if err != nil {
+		t.Fatalf("marshaling admission review: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatalf("parsing response: %v", err)
+	}
+	if review.Request != nil {
+		t.Error("expected the request to be stripped from the response")
+	}
+	if review.Response == nil || review.Response.UID != req.UID || !review.Response.Allowed {
+		t.Fatalf("unexpected response: %+v", review.Response)
+	}
+	expectLimit(t, applyPatch(t, req, review.Response).Spec.Containers[0], tpmrmResource, "1")
+
+	rec = httptest.NewRecorder()
+	w.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/mutate", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d for GET, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
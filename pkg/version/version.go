@@ -18,5 +18,74 @@ limitations under the License.
 // number, of course, but potentially any other version specific information as required.
 package version
 
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
 // Version of the TPM Device Plugin. This should be overwritten at compile time with a go linker flag.
 var Version string = "dev"
+
+// GitCommit is the git commit the TPM Device Plugin was built from. This should be overwritten at compile
+// time with a go linker flag, it falls back to the VCS information of the go toolchain otherwise.
+var GitCommit string
+
+// GitTreeState is "dirty" if the git tree had uncommitted changes at build time, and "clean" otherwise.
+// This should be overwritten at compile time with a go linker flag like GitCommit.
+var GitTreeState string
+
+// BuildDate is the time of the build in RFC 3339 format. This should be overwritten at compile time
+// with a go linker flag, it is empty otherwise.
+var BuildDate string
+
+// Info is all version information of a build
+type Info struct {
+	Version                string `json:"version"`
+	GitCommit              string `json:"gitCommit"`
+	GitTreeState           string `json:"gitTreeState"`
+	BuildDate              string `json:"buildDate"`
+	CommitDate             string `json:"commitDate"`
+	GoVersion              string `json:"goVersion"`
+	Platform               string `json:"platform"`
+	DevicePluginAPIVersion string `json:"devicePluginAPIVersion"`
+}
+
+// Get returns the version information of this build
+func Get() Info {
+	info := Info{
+		Version:                Version,
+		GitCommit:              GitCommit,
+		GitTreeState:           GitTreeState,
+		BuildDate:              BuildDate,
+		GoVersion:              runtime.Version(),
+		Platform:               runtime.GOOS + "/" + runtime.GOARCH,
+		DevicePluginAPIVersion: pluginapi.Version,
+	}
+	// go build embeds the VCS information since go 1.18, use it for everything the linker flags did not set
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.GitCommit == "":
+				info.GitCommit = s.Value
+			case s.Key == "vcs.time":
+				// NOTE: this is not the build date, which is only known if the linker flags set it
+				info.CommitDate = s.Value
+			case s.Key == "vcs.modified" && info.GitTreeState == "":
+				info.GitTreeState = "clean"
+				if s.Value == "true" {
+					info.GitTreeState = "dirty"
+				}
+			}
+		}
+	}
+	return info
+}
+
+// String implements fmt.Stringer
+func (i Info) String() string {
+	return fmt.Sprintf("Version: %s\nGit Commit: %s\nGit Tree State: %s\nBuild Date: %s\nCommit Date: %s\nGo Version: %s\nPlatform: %s\nDevice Plugin API Version: %s\n",
+		i.Version, i.GitCommit, i.GitTreeState, i.BuildDate, i.CommitDate, i.GoVersion, i.Platform, i.DevicePluginAPIVersion)
+}